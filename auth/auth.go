@@ -4,10 +4,75 @@ package auth
 
 import (
 	"context"
+	"io"
 	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
+// LoginOptions control how Login gets the authorization code
+type LoginOptions struct {
+	NoBrowser bool // don't try to open the auth URL in a browser
+
+	// Manual skips the callback server and reads the redirected URL from
+	// Input instead, e.g. when logging in over SSH. The URL must carry the
+	// state, a bare code fails with ErrCsrf. Prompts are written to Output.
+	Manual bool
+	Input  io.Reader
+	Output io.Writer
+
+	// CertFile is where to write a self-signed https callback certificate,
+	// so that it can be imported into the browser. Optional.
+	CertFile string
+
+	// PageTemplate is a html/template file for the page shown once the
+	// callback is handled, see CallbackPage. Optional.
+	PageTemplate string
+}
+
+// TokenStatus describes the stored token
+type TokenStatus struct {
+	Type       string
+	Valid      bool      // the access token can be used now
+	Expiry     time.Time // zero if the token doesn't expire
+	CanRefresh bool      // there is a refresh token
+}
+
+// StatusOf returns the status of tok
+func StatusOf(tok *oauth2.Token) TokenStatus {
+	return TokenStatus{
+		Type:       tok.Type(),
+		Valid:      tok.Valid(),
+		Expiry:     tok.Expiry,
+		CanRefresh: tok.RefreshToken != "",
+	}
+}
+
+// NeedsLogin is true if the token can't be used or refreshed
+func (s TokenStatus) NeedsLogin() bool {
+	return !s.Valid && !s.CanRefresh
+}
+
+// Authenticator logs in to a provider and hands out its tokens. Methods
+// other than Login return ErrNotLoggedIn if there is no stored token.
 type Authenticator interface {
-	Login() error
-	NewHttpClient(ctx context.Context) *http.Client
+	Login(ctx context.Context, opts LoginOptions) error
+
+	// Status reports on the stored token without refreshing it
+	Status(ctx context.Context) (TokenStatus, error)
+
+	// TokenSource returns valid tokens, refreshing and storing the token
+	// when it expires
+	TokenSource(ctx context.Context) (oauth2.TokenSource, error)
+
+	// NewHttpClient returns a client that authenticates requests with
+	// tokens from TokenSource
+	NewHttpClient(ctx context.Context) (*http.Client, error)
+
+	// RefreshToken refreshes the stored token even if it is still valid
+	RefreshToken(ctx context.Context) (*oauth2.Token, error)
+
+	// Logout revokes the stored token and deletes it
+	Logout(ctx context.Context) error
 }
@@ -0,0 +1,486 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+
+	"github.com/char8/mzutil/config"
+
+	"github.com/skratchdot/open-golang/open"
+)
+
+// CallbackCertKey is the store key of the self-signed https callback
+// certificate
+const CallbackCertKey = "callback-cert"
+
+// ProviderConfig describes an OAuth2 provider, so that the login flow and
+// token caching can be used with any API
+type ProviderConfig struct {
+	Name     string // names the stored token, see TokenKey
+	AuthURL  string
+	TokenURL string
+
+	// RevokeURL is POSTed to with the token on logout, optional
+	RevokeURL string
+
+	Scopes []string
+
+	// AuthStyle is how the client id and secret are sent to TokenURL, some
+	// providers don't accept HTTP basic auth
+	AuthStyle oauth2.AuthStyle
+
+	// ExtraParams are added to the auth URL
+	ExtraParams map[string]string
+
+	// Pkce is whether the provider takes a PKCE challenge, the default for
+	// ClientConfig.Pkce
+	Pkce bool
+
+	// UserIdField names the token response field holding the user id, to
+	// show after login. Optional.
+	UserIdField string
+}
+
+// NewAuthenticator returns an Authenticator for client c of provider p,
+// keeping its token in store. lock serialises token refreshes between
+// processes.
+func NewAuthenticator(p ProviderConfig, c ClientConfig, store config.ConfigStore, lock config.Locker) Authenticator {
+	return &oauthAuthenticator{
+		name: p.Name,
+		p:    p,
+		cc:   c,
+		c: oauth2.Config{
+			ClientID:     c.ClientId,
+			ClientSecret: c.ClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   p.AuthURL,
+				TokenURL:  p.TokenURL,
+				AuthStyle: p.AuthStyle,
+			},
+			RedirectURL: c.CallbackUrl,
+			Scopes:      p.Scopes,
+		},
+		s:           store,
+		lock:        lock,
+		openBrowser: true,
+	}
+}
+
+// generateRandomString generates a l byte random string
+// inspired by:
+// https://blog.questionable.services/article/generating-secure-random-numbers-crypto-rand/
+func generateRandomString(l int) (string, error) {
+	b := make([]byte, l)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(b), err
+}
+
+// oauthAuthenticator implements Authenticator for any ProviderConfig
+type oauthAuthenticator struct {
+	name        string
+	p           ProviderConfig
+	cc          ClientConfig
+	c           oauth2.Config      // the oauth2 config
+	s           config.ConfigStore // storage for secrets (tokens)
+	lock        config.Locker      // serialises token refreshes between processes
+	openBrowser bool
+}
+
+func (a *oauthAuthenticator) Login(ctx context.Context, opts LoginOptions) error {
+	state, err := generateRandomString(32)
+
+	if err != nil {
+		log.WithError(err).Error("Could not generate nonce")
+		return err
+	}
+
+	ac := a.cc
+
+	// check if callback URL is valid
+	err = ac.Validate()
+	if err != nil {
+		log.WithError(err).Error("bad oauth config")
+		return ErrBadConfig
+	}
+
+	// the redirect URL changes if the callback server picks the port
+	c := a.c
+
+	cu, _ := url.Parse(a.cc.CallbackUrl)
+
+	var srv *CallbackServer
+	if opts.Manual {
+		if cu.Port() == "0" {
+			log.Error("callback URL port 0 needs the callback server, set a port to use --manual")
+			return ErrBadConfig
+		}
+	} else {
+		srv, err = a.listen(ac, cu, opts)
+		if err != nil {
+			log.WithError(err).Error("could not start callback server")
+			return withCause(ErrAuthError, err)
+		}
+		defer srv.Close()
+
+		c.RedirectURL = callbackUrlWithPort(a.cc.CallbackUrl, srv.Port())
+	}
+
+	// a PKCE verifier ties the code to this process, so another local
+	// process that intercepts the callback can't exchange it
+	var authOpts, exchangeOpts []oauth2.AuthCodeOption
+	if a.cc.UsePkce(a.p) {
+		verifier := oauth2.GenerateVerifier()
+		authOpts = append(authOpts, oauth2.S256ChallengeOption(verifier))
+		exchangeOpts = append(exchangeOpts, oauth2.VerifierOption(verifier))
+	}
+
+	for k, v := range a.p.ExtraParams {
+		authOpts = append(authOpts, oauth2.SetAuthURLParam(k, v))
+	}
+
+	// give the user the URL to go to
+	authUrl := c.AuthCodeURL(state, authOpts...)
+	log.Infof("Authenticating by visiting: %v", authUrl)
+
+	// use xdg-open if openBrowser is set
+	if a.openBrowser && !opts.NoBrowser {
+		err = open.Start(authUrl)
+		if err != nil {
+			log.WithError(err).Warn("could not open browser, visit the URL by hand")
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 300*time.Second)
+	defer cancel()
+
+	// show the outcome on the callback page, if there is one
+	finish := func(r CallbackResult) {
+		if srv != nil {
+			srv.Finish(r)
+		}
+	}
+
+	var code, retState string
+	if opts.Manual {
+		code, retState, err = a.readCallback(waitCtx, authUrl, opts)
+	} else {
+		log.Infof("waiting for callback on %v", c.RedirectURL)
+		code, retState, err = srv.Wait(waitCtx)
+	}
+
+	if err == context.DeadlineExceeded {
+		err = ErrTimeout
+	}
+
+	if err != nil {
+		log.WithError(err).Error("authentication error")
+		finish(CallbackResult{Reason: ReasonOAuth, Err: err})
+		return withCause(ErrAuthError, err)
+	}
+
+	// a pasted bare code has no state, and can't be trusted either
+	if state != retState {
+		if retState == "" {
+			log.Error("no state in oauth callback, paste the full redirected URL")
+		} else {
+			log.Error("oauth callback state mismatch")
+		}
+		finish(CallbackResult{Reason: ReasonCsrf, Err: ErrCsrf})
+		return ErrCsrf
+	}
+
+	// exchange access token for auth token
+	tok, err := c.Exchange(ctx, code, exchangeOpts...)
+
+	if (err == nil) && !tok.Valid() {
+		err = errors.New("invalid token in response")
+	}
+
+	if err != nil {
+		log.WithError(err).Error("Could not exchange authorization code")
+		finish(CallbackResult{Reason: ReasonExchange, Err: err})
+		return ErrBadConfig
+	}
+
+	log.WithFields(log.Fields{
+		"type":   tok.Type(),
+		"expiry": tok.Expiry,
+		"valid":  tok.Valid(),
+	}).Info("got token")
+
+	err = PersistToken(a.s, a.name, tok)
+	if err != nil {
+		finish(CallbackResult{Err: fmt.Errorf("Could not store the token: %v", err)})
+		return err
+	}
+
+	var userId string
+	if a.p.UserIdField != "" {
+		userId, _ = tok.Extra(a.p.UserIdField).(string)
+	}
+	finish(CallbackResult{UserId: userId})
+	return nil
+}
+
+// listen starts the callback server, serving TLS for https callback URLs
+func (a *oauthAuthenticator) listen(ac ClientConfig, cu *url.URL, opts LoginOptions) (*CallbackServer, error) {
+	var page *template.Template
+	if opts.PageTemplate != "" {
+		var err error
+		page, err = LoadCallbackPage(opts.PageTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cu.Scheme != "https" {
+		return ListenForCallback(ac.CallbackAddr(), cu.Path, page)
+	}
+
+	cert, err := a.callbackCert(cu.Hostname(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return ListenForCallbackTLS(ac.CallbackAddr(), cu.Path, cert, page)
+}
+
+// callbackCert returns the configured certificate for https callbacks, or a
+// self-signed one kept in the store
+func (a *oauthAuthenticator) callbackCert(host string, opts LoginOptions) (tls.Certificate, error) {
+	if a.cc.TlsCertFile != "" {
+		return tls.LoadX509KeyPair(a.cc.TlsCertFile, a.cc.TlsKeyFile)
+	}
+
+	cert, created, err := CallbackCert(a.s, CallbackCertKey, host)
+	if err != nil {
+		return cert, err
+	}
+
+	explainCert(cert, created, opts)
+	return cert, nil
+}
+
+// explainCert tells the user how to get past the browser warning for a
+// self-signed callback certificate, writing it to opts.CertFile if set
+func explainCert(cert tls.Certificate, created bool, opts LoginOptions) {
+	out := loginOutput(opts)
+
+	fmt.Fprintf(out, "The callback server uses a self-signed certificate, SHA-256 fingerprint:\n\n\t%v\n\n",
+		CertFingerprint(cert))
+
+	if opts.CertFile != "" {
+		err := os.MkdirAll(filepath.Dir(opts.CertFile), config.DirPerms)
+		if err == nil {
+			err = ioutil.WriteFile(opts.CertFile, CertPEM(cert), config.FilePerms)
+		}
+		if err != nil {
+			log.WithError(err).Warn("could not write callback certificate")
+			opts.CertFile = ""
+		}
+	}
+
+	if !created {
+		return
+	}
+
+	fmt.Fprintln(out, "This is a new certificate, so your browser will warn about it when redirected")
+	fmt.Fprintln(out, "after login. Check the fingerprint matches, then accept the risk to continue.")
+
+	if opts.CertFile != "" {
+		fmt.Fprintf(out, "To trust it instead, import %v, e.g. for Chrome and Firefox on Linux:\n\n", opts.CertFile)
+		fmt.Fprintf(out, "\tcertutil -d sql:$HOME/.pki/nssdb -A -t P,, -n mzutil-callback -i %v\n\n", opts.CertFile)
+	}
+}
+
+// loginOutput returns where to write prompts for the user during login
+func loginOutput(opts LoginOptions) io.Writer {
+	if opts.Output == nil {
+		return os.Stderr
+	}
+	return opts.Output
+}
+
+// readCallback asks the user to visit authUrl and paste back the URL they are
+// redirected to, which needn't load
+func (a *oauthAuthenticator) readCallback(ctx context.Context, authUrl string, opts LoginOptions) (code, state string, err error) {
+	out := loginOutput(opts)
+
+	in := opts.Input
+	if in == nil {
+		in = os.Stdin
+	}
+
+	fmt.Fprintf(out, "Visit this URL in a browser and log in:\n\n\t%v\n\n", authUrl)
+	fmt.Fprintf(out, "You will be redirected to %v, which may fail to load.\n", a.cc.CallbackUrl)
+	fmt.Fprintln(out, "Paste the full URL from the address bar, including the state:")
+
+	type result struct {
+		code, state string
+		err         error
+	}
+
+	// reading can't be interrupted, so give up on it if ctx is done
+	c := make(chan result, 1)
+	go func() {
+		var r result
+		r.code, r.state, r.err = ReadCallbackInput(in)
+		c <- r
+	}()
+
+	select {
+	case r := <-c:
+		return r.code, r.state, r.err
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+}
+
+// loadToken returns the stored token, or ErrNotLoggedIn if there is none
+func (a *oauthAuthenticator) loadToken() (*oauth2.Token, error) {
+	tok := &oauth2.Token{}
+
+	err := a.s.ReadValue(TokenKey(a.name), tok)
+	if err == config.ErrNoConfig {
+		return nil, ErrNotLoggedIn
+	}
+	if err != nil {
+		log.WithError(err).Error("could not load token from store")
+		return nil, err
+	}
+
+	return tok, nil
+}
+
+func (a *oauthAuthenticator) Status(ctx context.Context) (TokenStatus, error) {
+	tok, err := a.loadToken()
+	if err != nil {
+		return TokenStatus{}, err
+	}
+
+	return StatusOf(tok), nil
+}
+
+func (a *oauthAuthenticator) TokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	tok, err := a.loadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newTokenSource(ctx, tok), nil
+}
+
+func (a *oauthAuthenticator) NewHttpClient(ctx context.Context) (*http.Client, error) {
+	ts, err := a.TokenSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHttpClient(ctx, ts), nil
+}
+
+// newHttpClient returns a client authorizing requests with tokens from ts.
+// Unlike oauth2.NewClient it doesn't wrap ts in an oauth2.ReuseTokenSource,
+// so every request asks ts, which notices tokens refreshed by other
+// processes. Requests go through the oauth2.HTTPClient in ctx, if any.
+func newHttpClient(ctx context.Context, ts oauth2.TokenSource) *http.Client {
+	base := http.DefaultTransport
+	if hc, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && (hc.Transport != nil) {
+		base = hc.Transport
+	}
+
+	return &http.Client{Transport: &oauth2.Transport{Source: ts, Base: base}}
+}
+
+// RefreshToken forces a refresh of the stored token using its refresh token.
+// The new token is persisted to the store by the cachedReuseTokenSource.
+func (a *oauthAuthenticator) RefreshToken(ctx context.Context) (*oauth2.Token, error) {
+	tok, err := a.loadToken()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := a.newTokenSource(ctx, tok).Refresh()
+	if err != nil {
+		log.WithError(err).Error("could not refresh token")
+		return nil, withCause(ErrAuthError, err)
+	}
+
+	return t, nil
+}
+
+// newTokenSource returns a token source that persists refreshed tokens to the
+// store, starting from tok
+func (a *oauthAuthenticator) newTokenSource(ctx context.Context, tok *oauth2.Token) RefreshTokenSource {
+	return NewTokenSource(a.name, a.s, a.lock, a.cc.RefreshAheadDuration(), tok,
+		func(t *oauth2.Token) oauth2.TokenSource {
+			return a.c.TokenSource(ctx, t)
+		})
+}
+
+// Logout revokes the stored token with the provider and deletes it from the
+// store. The token is deleted even if it couldn't be revoked, in which case
+// ErrLogout is returned.
+func (a *oauthAuthenticator) Logout(ctx context.Context) error {
+	tok, err := a.loadToken()
+	if err != nil {
+		return err
+	}
+
+	revokeErr := a.revoke(ctx, tok)
+
+	err = DeleteToken(a.s, a.name)
+	if err != nil {
+		return err
+	}
+
+	return revokeErr
+}
+
+// revoke invalidates tok and its refresh token with the provider's logout
+// endpoint, if it has one
+func (a *oauthAuthenticator) revoke(ctx context.Context, tok *oauth2.Token) error {
+	if a.p.RevokeURL == "" {
+		return nil
+	}
+
+	client := newHttpClient(ctx, a.newTokenSource(ctx, tok))
+	resp, err := client.PostForm(a.p.RevokeURL, url.Values{})
+	if err != nil {
+		log.WithError(err).Error("logout request error")
+		return ErrLogout
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		// the token has already expired or been revoked
+		log.Warn("token was already invalid on logout")
+		return nil
+	default:
+		log.WithField("statusCode", resp.StatusCode).Error("logout failed")
+		return ErrLogout
+	}
+}
@@ -2,86 +2,246 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
 // this file implements a simple callback handler for OAuth2 flows
 
-// callbackPayload stores the OAuth2 callback code and state strings for transfer
-// via a channel
+// callbackPayload stores the OAuth2 callback code and state strings, or the
+// error the authorization server redirected with, for transfer via a channel
 type callbackPayload struct {
 	code  string
 	state string
+	err   error
 }
 
 // Returned if we don't get a callback within the requested timeout period
 var ErrTimeout = errors.New("Timeout waiting for OAuth login")
 
-// makeHandler returns a http.HandleFunc for the OAuth2 callback URL. The passed
-// channel is to be used to retreive a callbackPayload struct
-func makeHandler(c chan callbackPayload) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
-		err := req.ParseForm()
-		if err != nil {
-			log.Printf("Could not parse callback req: %v", err)
-			http.Error(w, "Bad payload", 400)
-			return
-		}
+// CallbackError is an error passed back to the callback by the authorization
+// server, e.g. access_denied if the user declined the login
+type CallbackError struct {
+	Code        string // the error parameter
+	Description string // error_description, may be empty
+	URI         string // error_uri, may be empty
+}
+
+func (e *CallbackError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("OAuth error %v", e.Code)
+	}
+	return fmt.Sprintf("OAuth error %v: %v", e.Code, e.Description)
+}
+
+// callbackError returns a *CallbackError if v holds an OAuth2 error response
+func callbackError(v url.Values) error {
+	code := v.Get("error")
+	if code == "" {
+		return nil
+	}
+
+	return &CallbackError{
+		Code:        code,
+		Description: v.Get("error_description"),
+		URI:         v.Get("error_uri"),
+	}
+}
+
+// resultTimeout is how long the callback page waits for the login outcome
+const resultTimeout = time.Minute
+
+// handle is the http.HandlerFunc for the OAuth2 callback URL. The first
+// callback is passed to Wait, and its response held until Finish is called
+// so the page can show whether login succeeded.
+func (s *CallbackServer) handle(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		log.Printf("Could not parse callback req: %v", err)
+		http.Error(w, "Bad payload", 400)
+		return
+	}
 
-		state := req.Form.Get("state")
-		code := req.Form.Get("code")
+	p := callbackPayload{err: callbackError(req.Form)}
 
-		if (state == "") || (code == "") {
+	if p.err == nil {
+		p.state = req.Form.Get("state")
+		p.code = req.Form.Get("code")
+
+		if (p.state == "") || (p.code == "") {
 			log.Print("Callback missing params code & state")
 			http.Error(w, "Bad request", 400)
 			return
 		}
+	}
 
-		c <- callbackPayload{code: code, state: state}
+	select {
+	case s.c <- p:
+	default:
+		http.Error(w, "Login already in progress", http.StatusConflict)
+		return
+	}
 
-		w.WriteHeader(200)
-		w.Write([]byte("You may close this page"))
+	var r CallbackResult
+	select {
+	case r = <-s.result:
+	case <-s.done:
+		// closed without Finish, but Finish may have raced with Close
+		select {
+		case r = <-s.result:
+		default:
+			r = CallbackResult{Err: errors.New("Login was cancelled")}
+		}
+	case <-time.After(resultTimeout):
+		r = CallbackResult{Err: ErrTimeout}
+	case <-req.Context().Done():
+		return
 	}
+
+	renderPage(w, s.page, r)
 }
 
-// WaitForCallback spawns a server listening for a request with state and code
-// set as url parameters to the endpoint. Exits after timeout or on receipt of
-// a code/state pair.
-func WaitForCallback(addr, ep string, timeoutSeconds int) (code, state string, err error) {
-	c := make(chan callbackPayload)
+// CallbackServer listens for the OAuth2 callback on a loopback address
+type CallbackServer struct {
+	srv    *http.Server
+	l      net.Listener
+	page   *template.Template
+	c      chan callbackPayload
+	errc   chan error
+	result chan CallbackResult
+	done   chan struct{} // closed by Close
+	once   sync.Once
+}
 
-	mux := http.NewServeMux()
-	mux.Handle(ep, http.HandlerFunc(makeHandler(c)))
+// ListenForCallback starts a server on addr handling the callback endpoint
+// ep. Errors binding addr are returned straight away. If addr has port 0 a
+// free port is picked, see Port. page renders the outcome of the login, see
+// CallbackPage, if nil DefaultCallbackPage is used.
+func ListenForCallback(addr, ep string, page *template.Template) (*CallbackServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return serveCallback(l, ep, page), nil
+}
 
-	srv := &http.Server{Addr: addr, Handler: mux}
+// ListenForCallbackTLS is like ListenForCallback but serves https with cert
+func ListenForCallbackTLS(addr, ep string, cert tls.Certificate, page *template.Template) (*CallbackServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l = tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	return serveCallback(l, ep, page), nil
+}
 
-	// start the server in a goroutine so we can shut it down from the main
-	// goroutine
+// serveCallback serves the callback endpoint ep on l
+func serveCallback(l net.Listener, ep string, page *template.Template) *CallbackServer {
+	if page == nil {
+		page = DefaultCallbackPage
+	}
+
+	s := &CallbackServer{
+		l:      l,
+		page:   page,
+		c:      make(chan callbackPayload, 1),
+		errc:   make(chan error, 1),
+		result: make(chan CallbackResult, 1),
+		done:   make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(ep, http.HandlerFunc(s.handle))
+	s.srv = &http.Server{Handler: mux}
+
+	// serve in a goroutine so we can shut it down from the main goroutine
 	go func() {
-		log.Printf("Listening on %v for OAuth callback on %v", addr, ep)
-		if err := srv.ListenAndServe(); (err != nil) && (err != http.ErrServerClosed) {
-			// TODO: return error instead
-			log.Fatalf("OAuth callback server error: %v", err)
+		log.Printf("Listening on %v for OAuth callback on %v", l.Addr(), ep)
+		if err := s.srv.Serve(l); (err != nil) && (err != http.ErrServerClosed) {
+			s.errc <- err
 		}
 	}()
 
-	var result callbackPayload
+	return s
+}
+
+// Port returns the port the server is listening on
+func (s *CallbackServer) Port() int {
+	return s.l.Addr().(*net.TCPAddr).Port
+}
 
+// Wait waits for a request with state and code set as url parameters to the
+// endpoint. A *CallbackError is returned if the authorization server
+// redirected with an error, and ctx.Err() if ctx is done first. The browser
+// is kept waiting until Finish is called with the outcome of the login.
+func (s *CallbackServer) Wait(ctx context.Context) (code, state string, err error) {
 	select {
-	case result = <-c:
-		// we got a state, code pair from the handler
-		state, code = result.state, result.code
-	case <-time.After(time.Duration(timeoutSeconds) * time.Second):
-		// timed out waiting for callback
+	case result := <-s.c:
+		// we got a state, code pair or an error from the handler
+		return result.code, result.state, result.err
+	case err := <-s.errc:
+		return "", "", err
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+}
+
+// Finish shows r on the page for the callback returned by Wait. Only the
+// first call has any effect.
+func (s *CallbackServer) Finish(r CallbackResult) {
+	select {
+	case s.result <- r:
+	default:
+	}
+}
+
+// Close shuts the server down once the callback page has been sent, it is
+// safe to call more than once
+func (s *CallbackServer) Close() error {
+	var err error
+	s.once.Do(func() {
+		log.Printf("Shutting down server on %v", s.l.Addr())
+		close(s.done)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = s.srv.Shutdown(ctx)
+	})
+	return err
+}
+
+// WaitForCallback spawns a server on addr and waits for the callback on the
+// endpoint ep. Exits after timeout, when ctx is done or on receipt of a
+// code/state pair. The page only says whether the callback was received,
+// use ListenForCallback to show the outcome of the login.
+func WaitForCallback(ctx context.Context, addr, ep string, timeout time.Duration) (code, state string, err error) {
+	s, err := ListenForCallback(addr, ep, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	code, state, err = s.Wait(ctx)
+	s.Finish(CallbackResult{Err: err})
+	if err == context.DeadlineExceeded {
 		err = ErrTimeout
 	}
 
-	// shutdown the server
-	log.Printf("Shutting down server on %v", addr)
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
-	srv.Shutdown(ctx)
-	return
+	return code, state, err
 }
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"html/template"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// this file implements the page shown in the browser after the callback
+
+// Reasons a login failed, for CallbackResult.Reason
+const (
+	ReasonOAuth    = "oauth"    // the authorization server redirected with an error
+	ReasonCsrf     = "csrf"     // the state didn't match, the login may be forged
+	ReasonExchange = "exchange" // the code couldn't be exchanged for a token
+)
+
+// CallbackResult is the outcome of a login, shown on the callback page
+type CallbackResult struct {
+	UserId string // the user logged in as, if known
+	Reason string // one of the Reason constants if the login failed
+	Err    error  // nil on success
+}
+
+// CallbackPage is the data a callback page template is executed with
+type CallbackPage struct {
+	Success bool
+	UserId  string
+	Reason  string
+	Error   string
+}
+
+// DefaultCallbackPage is shown when no template file is given
+var DefaultCallbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mzutil login</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 4em auto; color: #222; }
+h1 { font-size: 1.4em; }
+.ok { color: #1a7f37; }
+.fail { color: #cf222e; }
+code { background: #eee; padding: 0.1em 0.3em; }
+</style>
+</head>
+<body>
+{{if .Success}}
+<h1 class="ok">Logged in</h1>
+{{if .UserId}}<p>Authenticated as <code>{{.UserId}}</code>.</p>{{end}}
+<p>You may close this page.</p>
+{{else if eq .Reason "csrf"}}
+<h1 class="fail">Login rejected</h1>
+<p>The state returned by the login didn't match the one mzutil sent, so the
+login may not have been started by you. No token was saved.</p>
+<p>Run <code>mzutil login</code> again.</p>
+{{else if eq .Reason "oauth"}}
+<h1 class="fail">Login declined</h1>
+<p>{{.Error}}</p>
+{{else if eq .Reason "exchange"}}
+<h1 class="fail">Login failed</h1>
+<p>The authorization code couldn't be exchanged for a token:</p>
+<p><code>{{.Error}}</code></p>
+<p>Check the client id, secret and callback URL with <code>mzutil doctor</code>.</p>
+{{else}}
+<h1 class="fail">Login failed</h1>
+<p>{{.Error}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+// LoadCallbackPage parses a callback page template from the file at path,
+// see CallbackPage for the data it is given
+func LoadCallbackPage(path string) (*template.Template, error) {
+	return template.ParseFiles(path)
+}
+
+// renderPage writes the page for r to w using t
+func renderPage(w http.ResponseWriter, t *template.Template, r CallbackResult) {
+	p := CallbackPage{
+		Success: r.Err == nil,
+		UserId:  r.UserId,
+		Reason:  r.Reason,
+	}
+
+	status := http.StatusOK
+	if r.Err != nil {
+		p.Error = r.Err.Error()
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := t.Execute(w, p)
+	if err != nil {
+		log.WithError(err).Error("could not render callback page")
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/char8/mzutil/config"
+)
+
+// this file implements the self-signed certificate for https callbacks
+
+// certLifetime is how long a generated callback certificate is valid for
+const certLifetime = 365 * 24 * time.Hour
+
+// storedCert is a certificate and its private key as stored, PEM encoded
+type storedCert struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// CallbackCert returns a self-signed certificate for host from store under
+// key, generating and storing a new one if there is none, it has expired or
+// it doesn't cover host. created is true if a new certificate was made, in
+// which case the user will need to trust it again.
+func CallbackCert(store config.ConfigStore, key, host string) (cert tls.Certificate, created bool, err error) {
+	var sc storedCert
+
+	err = store.ReadValue(key, &sc)
+	if err == nil {
+		cert, err = tls.X509KeyPair([]byte(sc.Cert), []byte(sc.Key))
+		if (err == nil) && certCovers(cert, host) {
+			return cert, false, nil
+		}
+		log.WithError(err).Info("replacing stored callback certificate")
+	}
+
+	certPEM, keyPEM, err := GenerateCert(host)
+	if err != nil {
+		return cert, false, err
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return cert, false, err
+	}
+
+	// a certificate that can't be stored still works, it just has to be
+	// trusted again next time
+	err = store.WriteValue(key, &storedCert{Cert: string(certPEM), Key: string(keyPEM)})
+	if err != nil {
+		log.WithError(err).Warn("could not store callback certificate")
+	}
+
+	return cert, true, nil
+}
+
+// certCovers checks that cert is valid for a while yet and is for host
+func certCovers(cert tls.Certificate, host string) bool {
+	if len(cert.Certificate) == 0 {
+		return false
+	}
+
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+
+	if time.Now().Add(24 * time.Hour).After(c.NotAfter) {
+		return false
+	}
+
+	return c.VerifyHostname(host) == nil
+}
+
+// GenerateCert returns a new self-signed certificate and private key, PEM
+// encoded, for host and the loopback addresses
+func GenerateCert(host string) (certPEM, keyPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"mzutil callback"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// CertPEM returns the PEM encoded leaf certificate of cert
+func CertPEM(cert tls.Certificate) []byte {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the leaf certificate of
+// cert, formatted as browsers show it
+func CertFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
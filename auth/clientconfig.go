@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientConfig is the OAuth2 client registered with a provider, as set up
+// by the user
+type ClientConfig struct {
+	ClientSecret string `json:"client_secret"`
+	ClientId     string `json:"client_id"`
+	CallbackUrl  string `json:"callback_url"`
+
+	// certificate and key for https callbacks, PEM files. A self-signed
+	// certificate is generated if these aren't set.
+	TlsCertFile string `json:"tls_cert_file,omitempty"`
+	TlsKeyFile  string `json:"tls_key_file,omitempty"`
+
+	// Pkce turns PKCE (RFC 7636) on or off for login, if nil it is on when
+	// the provider supports it
+	Pkce *bool `json:"pkce,omitempty"`
+
+	// RefreshAhead is how long before expiry to refresh the token, as a
+	// duration like "10m". DefaultRefreshAhead if empty.
+	RefreshAhead string `json:"refresh_ahead,omitempty"`
+}
+
+// DefaultRefreshAhead is the refresh-ahead window if none is configured
+const DefaultRefreshAhead = 5 * time.Minute
+
+// RefreshAheadDuration returns the refresh-ahead window, which should be
+// checked with Validate first
+func (c *ClientConfig) RefreshAheadDuration() time.Duration {
+	d, err := time.ParseDuration(c.RefreshAhead)
+	if (c.RefreshAhead == "") || (err != nil) || (d < 0) {
+		return DefaultRefreshAhead
+	}
+	return d
+}
+
+// UsePkce returns whether login with provider p should use PKCE
+func (c *ClientConfig) UsePkce(p ProviderConfig) bool {
+	if c.Pkce == nil {
+		return p.Pkce
+	}
+	return *c.Pkce
+}
+
+// Validate checks that the client id and secret are set and that the
+// callback URL is a valid http or https URL
+func (c *ClientConfig) Validate() error {
+	if (c.ClientSecret == "") || (c.ClientId == "") {
+		return NewClientError(4, "Client id and secret must be set")
+	}
+
+	if (c.TlsCertFile == "") != (c.TlsKeyFile == "") {
+		return NewClientError(4, "TLS cert and key files must be set together")
+	}
+
+	err := ValidateCallbackUrl(c.CallbackUrl)
+	if err != nil {
+		return err
+	}
+
+	if c.RefreshAhead != "" {
+		d, err := time.ParseDuration(c.RefreshAhead)
+		if (err != nil) || (d < 0) {
+			return NewClientError(4, "Invalid refresh ahead duration: "+c.RefreshAhead)
+		}
+	}
+
+	if (c.TlsCertFile != "") && !strings.HasPrefix(c.CallbackUrl, "https:") {
+		return NewClientError(4, "TLS cert and key files need an https callback URL")
+	}
+
+	return nil
+}
+
+// ValidateCallbackUrl checks that u is a http or https URL with a host and,
+// if it has one, a valid port. Port 0 picks a free port at login.
+func ValidateCallbackUrl(u string) error {
+	cu, err := url.Parse(u)
+
+	switch {
+	case err != nil:
+		return NewClientError(4, "Invalid callback URL: "+err.Error())
+	case (cu.Scheme != "http") && (cu.Scheme != "https"):
+		return NewClientError(4, "Scheme for callback URL must be http or https")
+	case cu.Hostname() == "":
+		return NewClientError(4, "Callback URL must have a host")
+	}
+
+	if p := cu.Port(); p != "" {
+		n, err := strconv.Atoi(p)
+		if (err != nil) || (n < 0) || (n > 65535) {
+			return NewClientError(4, "Invalid callback URL port: "+p)
+		}
+	}
+
+	return nil
+}
+
+// CallbackAddr returns the loopback address to listen on for the OAuth2
+// callback, which should be checked with Validate first
+func (c *ClientConfig) CallbackAddr() string {
+	port := "80"
+
+	cu, err := url.Parse(c.CallbackUrl)
+	switch {
+	case err != nil:
+	case cu.Port() != "":
+		port = cu.Port()
+	case cu.Scheme == "https":
+		port = "443"
+	}
+
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// callbackUrlWithPort returns u with its port replaced by port
+func callbackUrlWithPort(u string, port int) string {
+	cu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+
+	cu.Host = net.JoinHostPort(cu.Hostname(), strconv.Itoa(port))
+	return cu.String()
+}
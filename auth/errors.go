@@ -0,0 +1,64 @@
+package auth
+
+// ClientError packages an error string and exit code as most errors are fatal
+type ClientError struct {
+	s        string
+	exitCode int
+	base     error // the error this was made from by withCause, if any
+	cause    error
+}
+
+func (c *ClientError) Error() string {
+	return c.s
+}
+
+func (c *ClientError) ExitCode() int {
+	return c.exitCode
+}
+
+// Is matches the ClientError this error was made from by withCause
+func (c *ClientError) Is(target error) bool {
+	return (c.base != nil) && (c.base == target)
+}
+
+func (c *ClientError) Unwrap() error {
+	return c.cause
+}
+
+// withCause returns a copy of the ClientError base that adds the message of
+// cause and wraps it, so that errors.As can find e.g. a *CallbackError
+func withCause(base, cause error) error {
+	c, ok := base.(*ClientError)
+	if !ok {
+		return cause
+	}
+
+	return &ClientError{
+		s:        c.s + ": " + cause.Error(),
+		exitCode: c.exitCode,
+		base:     base,
+		cause:    cause,
+	}
+}
+
+func NewClientError(exitCode int, err string) error {
+	return &ClientError{exitCode: exitCode, s: err}
+}
+
+// ErrAuthError returned on OAuth2 error
+var ErrAuthError = NewClientError(3, "Authentication Error")
+
+// ErrBadConfig returned if client_secret, client_id not set
+var ErrBadConfig = NewClientError(4, "Bad auth configuration")
+
+// ErrCsrf returns if there's a csrf error on the oauth callback
+var ErrCsrf = NewClientError(5, "CSRF token mistmatch")
+
+// ErrNotLoggedIn returned if there is no stored token, run `mzutil login`
+var ErrNotLoggedIn = NewClientError(6, "Not logged in")
+
+// ErrLogout returned if the token could not be revoked on logout
+var ErrLogout = NewClientError(7, "Could not revoke token")
+
+// ErrLoginRequired returned if the token can't be refreshed any more
+var ErrLoginRequired = NewClientError(8, "Login required, the token can no longer be refreshed")
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// this file implements reading the OAuth2 callback by hand, for when the
+// callback server can't be reached from the browser
+
+// Returned if the pasted callback has no authorization code
+var ErrNoCode = errors.New("No authorization code in input")
+
+// ReadCallbackInput reads a line from r holding either the URL the browser
+// was redirected to, its query string or the bare authorization code. state
+// is empty if only the code was given. A *CallbackError is returned if the
+// redirect carried an OAuth2 error.
+func ReadCallbackInput(r io.Reader) (code, state string, err error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if (err != nil) && ((err != io.EOF) || (line == "")) {
+		return "", "", err
+	}
+
+	return ParseCallbackInput(line)
+}
+
+// ParseCallbackInput extracts the code and state from s, see
+// ReadCallbackInput
+func ParseCallbackInput(s string) (code, state string, err error) {
+	s = strings.TrimSpace(s)
+
+	if i := strings.Index(s, "#"); i >= 0 {
+		s = s[:i]
+	}
+
+	q := s
+	if i := strings.Index(s, "?"); i >= 0 {
+		q = s[i+1:]
+	}
+
+	if !strings.Contains(q, "=") {
+		// a bare code, which can't contain / or whitespace
+		if (s == "") || strings.ContainsAny(s, "/ \t") {
+			return "", "", ErrNoCode
+		}
+		return s, "", nil
+	}
+
+	v, err := url.ParseQuery(q)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = callbackError(v)
+	if err != nil {
+		return "", "", err
+	}
+
+	code = v.Get("code")
+	if code == "" {
+		return "", "", ErrNoCode
+	}
+
+	return code, v.Get("state"), nil
+}
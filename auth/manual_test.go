@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/char8/mzutil/config"
+)
+
+func TestParseCallbackInput(t *testing.T) {
+	for _, c := range []struct {
+		in          string
+		code, state string
+		err         error
+	}{
+		{in: "http://localhost:8080/callback?code=abc&state=xyz", code: "abc", state: "xyz"},
+		{in: "  http://localhost:8080/callback?state=xyz&code=abc#frag\n", code: "abc", state: "xyz"},
+		{in: "code=abc&state=xyz", code: "abc", state: "xyz"},
+		{in: "?code=abc&state=a%3Db", code: "abc", state: "a=b"},
+		{in: "http://localhost:8080/callback?code=abc", code: "abc"},
+		{in: "abc", code: "abc"},
+		{in: "abc\n", code: "abc"},
+		{in: "", err: ErrNoCode},
+		{in: "http://localhost:8080/callback", err: ErrNoCode},
+		{in: "http://localhost:8080/callback?state=xyz", err: ErrNoCode},
+		{in: "not a code", err: ErrNoCode},
+	} {
+		code, state, err := ParseCallbackInput(c.in)
+		if err != c.err {
+			t.Errorf("ParseCallbackInput(%q) returned error %v, want %v", c.in, err, c.err)
+			continue
+		}
+
+		if (code != c.code) || (state != c.state) {
+			t.Errorf("ParseCallbackInput(%q) = %q, %q, want %q, %q", c.in, code, state, c.code, c.state)
+		}
+	}
+}
+
+func TestParseCallbackInputError(t *testing.T) {
+	_, _, err := ParseCallbackInput("http://localhost:8080/callback?error=access_denied&error_description=no&state=xyz")
+
+	var cerr *CallbackError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("returned %v, want a *CallbackError", err)
+	}
+
+	if (cerr.Code != "access_denied") || (cerr.Description != "no") {
+		t.Errorf("returned %+v", cerr)
+	}
+}
+
+func TestReadCallbackInput(t *testing.T) {
+	code, state, err := ReadCallbackInput(strings.NewReader("code=abc&state=xyz\nignored\n"))
+	if (err != nil) || (code != "abc") || (state != "xyz") {
+		t.Errorf("returned %q, %q, %v", code, state, err)
+	}
+
+	// a last line without a newline is fine
+	code, _, err = ReadCallbackInput(strings.NewReader("abc"))
+	if (err != nil) || (code != "abc") {
+		t.Errorf("returned %q, %v for input without a newline", code, err)
+	}
+
+	_, _, err = ReadCallbackInput(strings.NewReader(""))
+	if err != io.EOF {
+		t.Errorf("returned %v for empty input, want io.EOF", err)
+	}
+}
+
+// callbackPaster plays the user in a manual login: once the auth URL has been
+// printed it pastes the line returned by paste for the state in that URL
+type callbackPaster struct {
+	paste func(state string) string
+	in    *io.PipeWriter
+
+	mu     sync.Mutex
+	out    bytes.Buffer
+	pasted bool
+}
+
+var urlPattern = regexp.MustCompile(`https?://\S+`)
+
+func (p *callbackPaster) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.out.Write(b)
+	if p.pasted || !strings.Contains(p.out.String(), "Paste") {
+		return len(b), nil
+	}
+	p.pasted = true
+
+	u, err := url.Parse(urlPattern.FindString(p.out.String()))
+	if err != nil {
+		return 0, err
+	}
+
+	go fmt.Fprintln(p.in, p.paste(u.Query().Get("state")))
+	return len(b), nil
+}
+
+// manualLogin runs a manual login against a stub token endpoint, pasting the
+// line returned by paste. It returns whether the code was exchanged for a
+// token and the error from Login.
+func manualLogin(t *testing.T, paste func(state string) string) (bool, error) {
+	t.Helper()
+
+	var mu sync.Mutex
+	exchanged := false
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		exchanged = true
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"at","refresh_token":"rt","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer srv.Close()
+
+	p := ProviderConfig{Name: "test", AuthURL: "https://auth.example.com/", TokenURL: srv.URL}
+	c := ClientConfig{ClientId: "id", ClientSecret: "secret", CallbackUrl: "http://localhost:8080/callback"}
+	a := NewAuthenticator(p, c, config.NewMemConfigStore(), config.NewFileLock(t.TempDir()+"/lock"))
+
+	r, w := io.Pipe()
+	defer w.Close()
+
+	err := a.Login(context.Background(), LoginOptions{
+		NoBrowser: true,
+		Manual:    true,
+		Input:     r,
+		Output:    &callbackPaster{paste: paste, in: w},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	return exchanged, err
+}
+
+func TestManualLoginChecksState(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		paste func(state string) string
+		err   error
+	}{
+		{
+			name: "full URL",
+			paste: func(state string) string {
+				return "http://localhost:8080/callback?" + url.Values{"code": {"abc"}, "state": {state}}.Encode()
+			},
+		},
+		{
+			name:  "bare code",
+			paste: func(string) string { return "abc" },
+			err:   ErrCsrf,
+		},
+		{
+			name:  "URL without state",
+			paste: func(string) string { return "http://localhost:8080/callback?code=abc" },
+			err:   ErrCsrf,
+		},
+		{
+			name:  "wrong state",
+			paste: func(string) string { return "http://localhost:8080/callback?code=abc&state=forged" },
+			err:   ErrCsrf,
+		},
+	} {
+		exchanged, err := manualLogin(t, c.paste)
+		if err != c.err {
+			t.Errorf("%v: Login returned %v, want %v", c.name, err, c.err)
+		}
+
+		// the code mustn't be used unless the state matched
+		if exchanged != (c.err == nil) {
+			t.Errorf("%v: code exchanged = %v", c.name, exchanged)
+		}
+	}
+}
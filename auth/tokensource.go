@@ -1,7 +1,9 @@
 package auth
 
 import (
+	"errors"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -9,11 +11,13 @@ import (
 	"golang.org/x/oauth2"
 )
 
+// ErrNoToken is returned when a token is needed but none has been stored
+var ErrNoToken = errors.New("No OAuth2 token found")
+
 // PersistToken stores a oauth2 token in the specified store with the key
-// set to the token name prefixed by `oauth_token:`
+// set to the token name prefixed by TokenKeyPrefix
 func PersistToken(store config.ConfigStore, name string, t *oauth2.Token) error {
-	key := "oauth_token:" + name
-	err := store.WriteValue(key, t)
+	err := store.WriteValue(TokenKey(name), t)
 	if err != nil {
 		log.WithError(err).Error("could not persist oauth2 token")
 	}
@@ -24,7 +28,7 @@ func PersistToken(store config.ConfigStore, name string, t *oauth2.Token) error
 // been stored with the key set to `oauth_token:`+name
 func FetchToken(store config.ConfigStore, name string) *oauth2.Token {
 	tok := &oauth2.Token{}
-	err := store.ReadValue("oauth_token:"+name, tok)
+	err := store.ReadValue(TokenKey(name), tok)
 	if err != nil {
 		log.WithError(err).Error("could not load token from store")
 		tok = nil
@@ -32,33 +36,156 @@ func FetchToken(store config.ConfigStore, name string) *oauth2.Token {
 	return tok
 }
 
+// RefreshTokenSource is an oauth2.TokenSource that can also be forced to
+// fetch a new token, regardless of whether the current one is still valid
+type RefreshTokenSource interface {
+	oauth2.TokenSource
+	Refresh() (*oauth2.Token, error)
+}
+
+// DeleteToken removes a token stored by PersistToken. It is not an error if
+// there is no token to delete.
+func DeleteToken(store config.ConfigStore, name string) error {
+	err := store.DeleteValue(TokenKey(name))
+	if err == config.ErrNoConfig {
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).Error("could not delete oauth2 token")
+	}
+	return err
+}
+
+// TokenKeyPrefix starts the store key of every token
+const TokenKeyPrefix = "oauth_token:"
+
+// TokenKey returns the store key for the token called name
+func TokenKey(name string) string {
+	return TokenKeyPrefix + name
+}
+
 // cachedReuseTokenSource wraps a TokenSource and is very simillar to
 // oauth2.ReuseTokenSource except that it calls PersistToken
 // when a new Token is retrieved
 // This is closely based off the solution posted by @j0hnsmith
 // in https://github.com/golang/oauth2/issues/84
+//
+// Refresh tokens are single use, so refreshes are serialised between
+// processes with lock, and the token is re-read from the store once the lock
+// is held in case another process has already rotated it. Long running
+// processes also pick up tokens refreshed elsewhere, e.g. by `token
+// keepalive`, by re-reading the store every storeRecheck.
 type cachedReuseTokenSource struct {
 	name string
-	new  oauth2.TokenSource
+	new  func(*oauth2.Token) oauth2.TokenSource
 
 	store config.ConfigStore
+	lock  config.Locker
+	ahead time.Duration // refresh this long before the token expires
 
-	mu sync.Mutex // guards t
-	t  *oauth2.Token
+	mu   sync.Mutex // guards t and read
+	t    *oauth2.Token
+	read time.Time // when the store was last checked for a newer token
 }
 
-// Ensure that we satisfy the TokenSource interface
-var _ oauth2.TokenSource = &cachedReuseTokenSource{}
+// storeRecheck is how often Token looks for a token refreshed by another
+// process, rather than reading the store on every request
+const storeRecheck = time.Minute
+
+// Ensure that we satisfy the RefreshTokenSource interface
+var _ RefreshTokenSource = &cachedReuseTokenSource{}
 
 func (c *cachedReuseTokenSource) Token() (*oauth2.Token, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	// if the current token is valid, return it
-	if c.t.Valid() {
+
+	if time.Since(c.read) > storeRecheck {
+		c.reload()
+	}
+
+	// if the current token is valid for a while yet, return it
+	if c.fresh(c.t) {
+		return c.t, nil
+	}
+
+	t, err := c.refresh(false)
+	if (err != nil) && c.t.Valid() {
+		// refreshing early failed, but the old token still works for now
+		log.WithError(err).Warn("could not refresh token ahead of expiry")
 		return c.t, nil
 	}
-	// get a new token
-	t, err := c.new.Token()
+	return t, err
+}
+
+// reload replaces the token with the stored one if that differs, so a token
+// refreshed by another process is used rather than the one it replaced.
+// c.mu must be held.
+func (c *cachedReuseTokenSource) reload() {
+	c.read = time.Now()
+
+	t := &oauth2.Token{}
+	err := c.store.ReadValue(TokenKey(c.name), t)
+	if err != nil {
+		log.WithError(err).Debug("could not re-read token from store")
+		return
+	}
+
+	if (c.t == nil) || (t.AccessToken != c.t.AccessToken) {
+		log.Debug("using token refreshed by another process")
+		c.t = t
+	}
+}
+
+// fresh is true if t is valid and doesn't expire within the refresh-ahead
+// window
+func (c *cachedReuseTokenSource) fresh(t *oauth2.Token) bool {
+	if !t.Valid() {
+		return false
+	}
+	return t.Expiry.IsZero() || (time.Until(t.Expiry) > c.ahead)
+}
+
+func (c *cachedReuseTokenSource) Refresh() (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refresh(true)
+}
+
+// refresh gets a new token while holding the inter-process lock. Unless force
+// is set a valid token persisted by another process is used instead.
+// c.mu must be held.
+func (c *cachedReuseTokenSource) refresh(force bool) (*oauth2.Token, error) {
+	err := c.lock.Lock()
+	if err != nil {
+		log.WithError(err).Error("could not acquire token lock")
+		return nil, err
+	}
+
+	defer c.lock.Unlock()
+
+	// re-read the token, another process may have refreshed it while we
+	// waited for the lock
+	t := FetchToken(c.store, c.name)
+	if t == nil {
+		t = c.t
+	}
+
+	if t == nil {
+		return nil, ErrNoToken
+	}
+
+	c.read = time.Now()
+	if !force && c.fresh(t) {
+		c.t = t
+		return t, nil
+	}
+
+	// expire a copy of the token so that the wrapped TokenSource uses the
+	// refresh token rather than handing it back
+	expired := *t
+	expired.Expiry = time.Now().Add(-time.Minute)
+
+	t, err = c.new(&expired).Token()
 	if err != nil {
 		return nil, err
 	}
@@ -69,9 +196,20 @@ func (c *cachedReuseTokenSource) Token() (*oauth2.Token, error) {
 	return t, nil
 }
 
-// NewTokenSource constructs a new cachedReuseTokenSource instance
-func NewTokenSource(name string, store config.ConfigStore, tok *oauth2.Token,
-	ts oauth2.TokenSource) oauth2.TokenSource {
+// NewTokenSource constructs a new cachedReuseTokenSource instance. newSource
+// returns a TokenSource that refreshes the token passed to it. lock is held
+// around reading, refreshing and persisting the token. Tokens are refreshed
+// once they are within ahead of expiring.
+func NewTokenSource(name string, store config.ConfigStore, lock config.Locker, ahead time.Duration,
+	tok *oauth2.Token, newSource func(*oauth2.Token) oauth2.TokenSource) RefreshTokenSource {
 
-	return &cachedReuseTokenSource{name: name, new: ts, store: store, t: tok}
+	return &cachedReuseTokenSource{
+		name:  name,
+		new:   newSource,
+		store: store,
+		lock:  lock,
+		ahead: ahead,
+		t:     tok,
+		read:  time.Now(),
+	}
 }
@@ -23,7 +23,11 @@ var accountCmd = &cobra.Command{
 var formatStr = "%-30v%-21v%-v\n"
 
 func accountRun(cmd *cobra.Command, args []string) error {
-	client, err := getClient(context.Background())
+	client, done, err := getAPI(context.Background())
+	if err != nil {
+		return err
+	}
+	defer done()
 
 	accounts, err := client.Accounts()
 
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/char8/mzutil/monzo"
 	"github.com/spf13/cobra"
 )
 
@@ -20,14 +19,11 @@ var balanceCmd = &cobra.Command{
 }
 
 func balanceRun(cmd *cobra.Command, args []string) error {
-	store := getConfigStore()
-
-	auth, err := monzo.NewAuthenticator(store)
+	client, done, err := getAPI(context.Background())
 	if err != nil {
 		return err
 	}
-
-	client := monzo.NewClient(context.Background(), auth)
+	defer done()
 
 	bal, err := client.Balance(args[0])
 
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/char8/mzutil/daemon"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flag - time between polls in `daemon`
+var daemonInterval time.Duration
+
+// set by flag - how far back `daemon` keeps transactions
+var daemonHistory time.Duration
+
+// set by flag - call the API directly even if the daemon is running
+var noDaemon bool
+
+func init() {
+	daemonCmd.Flags().DurationVar(&daemonInterval, "interval", 5*time.Minute,
+		"Time between polls of balances and transactions")
+	daemonCmd.Flags().DurationVar(&daemonHistory, "history", 31*24*time.Hour,
+		"Keep transactions from this far back")
+
+	daemonCmd.AddCommand(daemonStatusCmd)
+	rootCmd.AddCommand(daemonCmd)
+
+	rootCmd.PersistentFlags().BoolVar(&noDaemon, "no-daemon", false,
+		"Call the API directly even if mzutil daemon is running")
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Poll the API and serve the results to other mzutil commands",
+	Long: `Hold the token, poll balances and transactions every --interval and serve
+the results over a Unix socket. While it runs, commands such as balance and
+accounts ask the daemon instead of calling the API, unless --no-daemon is set.
+
+The socket is $XDG_RUNTIME_DIR/mzutil/<profile>.sock, or daemon.sock in the
+cache dir, and can be set with $MZUTIL_SOCKET. Under systemd socket
+activation the socket passed in is used instead, see install-service.`,
+	Args: cobra.NoArgs,
+	RunE: daemonRun,
+}
+
+var daemonStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show whether the daemon is running and when it last polled",
+	Args:  cobra.NoArgs,
+	RunE:  daemonStatusRun,
+}
+
+var ErrDaemonNotRunning = errors.New("the daemon is not running")
+
+func daemonRun(cmd *cobra.Command, args []string) error {
+	path, err := daemonSocket()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	// systemd owns the socket if it was passed in, so it's left in place
+	l, err := daemon.ActivationListener()
+	if err != nil {
+		return err
+	}
+
+	if l == nil {
+		l, err = daemon.Listen(path)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+	} else {
+		path = l.Addr().String()
+	}
+
+	s := daemon.NewServer(client, daemon.Options{
+		Interval: daemonInterval,
+		History:  daemonHistory,
+	})
+
+	go s.Run(ctx)
+
+	log.Infof("daemon listening on %v", path)
+	return s.Serve(ctx, l)
+}
+
+func daemonStatusRun(cmd *cobra.Command, args []string) error {
+	path, err := daemonSocket()
+	if err != nil {
+		return err
+	}
+
+	c, err := daemon.Dial(path)
+	if err != nil {
+		log.WithError(err).Debug("could not connect to daemon")
+		return ErrDaemonNotRunning
+	}
+	defer c.Close()
+
+	s, err := c.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Socket: %v\n", path)
+	fmt.Printf("\tStarted: %v\n", s.Started.Format(time.RFC822))
+	if s.Updated.IsZero() {
+		fmt.Println("\tUpdated: never")
+	} else {
+		fmt.Printf("\tUpdated: %v\n", s.Updated.Format(time.RFC822))
+	}
+	fmt.Printf("\tAccounts: %v\n", s.Accounts)
+	if s.LastError != "" {
+		fmt.Printf("\tLast error: %v\n", s.LastError)
+	}
+
+	return nil
+}
+
+// daemonSocket returns the path of the daemon socket for the current profile
+func daemonSocket() (string, error) {
+	if p := os.Getenv(monzo.DaemonSocketEnv); p != "" {
+		return p, nil
+	}
+
+	profile, err := currentProfile()
+	if err != nil {
+		return "", err
+	}
+
+	// a config dir keeps everything in one place, so the socket goes there too
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if (runtime != "") && (configDir == "") && (os.Getenv(monzo.ConfigDirEnv) == "") {
+		return filepath.Join(runtime, monzo.AppName, profile+".sock"), nil
+	}
+
+	dirs, err := profileDirs(profile)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirs.Cache, monzo.DaemonSocketFile), nil
+}
+
+// api is what commands use to get results, either a monzo.Client or a
+// connection to the daemon
+type api interface {
+	Accounts() ([]monzo.AccountResponse, error)
+	Balance(accountId string) (monzo.BalanceResponse, error)
+}
+
+// getAPI returns a connection to the daemon if it is running, otherwise a
+// monzo.Client. Call the returned func when done with it.
+func getAPI(ctx context.Context) (api, func(), error) {
+	if !noDaemon {
+		path, err := daemonSocket()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c, err := daemon.Dial(path)
+		if err == nil {
+			log.Debugf("using daemon on %v", path)
+			return c, func() { c.Close() }, nil
+		}
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, func() {}, nil
+}
@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/char8/mzutil/auth"
+	"github.com/char8/mzutil/config"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flag - fix problems that doctor can fix, e.g. file permissions
+var doctorFix bool
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorFix, "fix", false,
+		"Fix problems where possible, e.g. file permissions")
+
+	rootCmd.AddCommand(doctorCmd)
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose setup problems",
+	Long: `Check the secret store, file permissions, auth config, callback port,
+OAuth2 token and API access, printing hints for anything that fails`,
+	Args: cobra.NoArgs,
+	RunE: doctorRun,
+
+	// the report already explains failures
+	SilenceUsage: true,
+}
+
+var ErrDoctorFailed = errors.New("some checks failed")
+
+// doctorReport prints the outcome of each check
+type doctorReport struct {
+	failed int
+}
+
+func (r *doctorReport) pass(name, detail string) {
+	fmt.Printf("[ OK ] %v: %v\n", name, detail)
+}
+
+func (r *doctorReport) skip(name, reason string) {
+	fmt.Printf("[SKIP] %v: %v\n", name, reason)
+}
+
+func (r *doctorReport) fail(name string, err error, hint string) {
+	r.failed++
+	fmt.Printf("[FAIL] %v: %v\n", name, err)
+	if hint != "" {
+		fmt.Printf("       hint: %v\n", hint)
+	}
+}
+
+func doctorRun(cmd *cobra.Command, args []string) error {
+	r := &doctorReport{}
+
+	doctorCheckDirs(r)
+
+	store, err := getConfigStore()
+	if err != nil {
+		r.fail("store", err, "check the --store option")
+		return ErrDoctorFailed
+	}
+
+	if !doctorCheckStore(r, store) {
+		r.skip("auth config", "store not reachable")
+		return ErrDoctorFailed
+	}
+
+	ac, ok := doctorCheckAuthConfig(r, store)
+	if ok {
+		doctorCheckCallbackPort(r, ac)
+	} else {
+		r.skip("callback port", "no valid auth config")
+	}
+
+	switch {
+	case !doctorCheckToken(r, store):
+		r.skip("api", "not logged in")
+	case !ok:
+		r.skip("api", "no valid auth config")
+	default:
+		doctorCheckApi(r, store)
+	}
+
+	if r.failed > 0 {
+		return ErrDoctorFailed
+	}
+
+	return nil
+}
+
+// doctorCheckDirs checks the permissions of the file store directories
+func doctorCheckDirs(r *doctorReport) {
+	dirs, err := getDirs()
+	if err != nil {
+		r.fail("dirs", err, "set $HOME, or use --config-dir")
+		return
+	}
+
+	paths := []string{dirs.Config, dirs.Data, filepath.Join(dirs.Data, monzo.EncryptedStoreDir)}
+	seen := make(map[string]bool)
+
+	for _, p := range paths {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		bad, err := config.CheckPerms(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			r.fail("permissions", err, "")
+			continue
+		}
+
+		if len(bad) == 0 {
+			r.pass("permissions", p)
+			continue
+		}
+
+		for _, e := range bad {
+			if !doctorFix {
+				r.fail("permissions", e, fmt.Sprintf("chmod %#o %v, or run mzutil doctor --fix", e.Want, e.Path))
+				continue
+			}
+
+			err := os.Chmod(e.Path, e.Want)
+			if err != nil {
+				r.fail("permissions", err, "")
+				continue
+			}
+			r.pass("permissions", fmt.Sprintf("set %v to %#o", e.Path, e.Want))
+		}
+	}
+}
+
+// doctorCheckStore checks that the store can be used, returning false if not
+func doctorCheckStore(r *doctorReport, store config.ConfigStore) bool {
+	usesKeychain := false
+	for _, s := range getStoreSpecs() {
+		usesKeychain = usesKeychain || strings.HasPrefix(s, "keychain")
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		hint := "check the store is unlocked and reachable"
+		switch {
+		case errors.Is(err, config.ErrInvalidPerms):
+			hint = "run mzutil doctor --fix"
+		case usesKeychain:
+			hint = "check the keychain is unlocked, e.g. run in a desktop session, or use --store file: or --store encrypted:"
+		}
+		r.fail("store", err, hint)
+		return false
+	}
+
+	r.pass("store", fmt.Sprintf("%v holds %v keys", store, len(keys)))
+	return true
+}
+
+// doctorCheckAuthConfig checks that a valid auth config is stored
+func doctorCheckAuthConfig(r *doctorReport, store config.ConfigStore) (monzo.AuthConfig, bool) {
+	var ac monzo.AuthConfig
+
+	err := store.ReadValue(monzo.AuthConfigKey, &ac)
+	if err == config.ErrNoConfig {
+		r.fail("auth config", err, "run mzutil setup")
+		return ac, false
+	}
+	if err != nil {
+		r.fail("auth config", err, "")
+		return ac, false
+	}
+
+	err = ac.Validate()
+	if err != nil {
+		r.fail("auth config", err, "run mzutil setup")
+		return ac, false
+	}
+
+	r.pass("auth config", fmt.Sprintf("client %v, callback %v", ac.ClientId, ac.CallbackUrl))
+	return ac, true
+}
+
+// doctorCheckCallbackPort checks that the callback server could listen
+func doctorCheckCallbackPort(r *doctorReport, ac monzo.AuthConfig) {
+	addr := ac.CallbackAddr()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		r.fail("callback port", err,
+			"stop whatever is using the port, or use another port in the callback URL (ports below 1024 need root)")
+		return
+	}
+
+	l.Close()
+	r.pass("callback port", addr+" is free")
+}
+
+// doctorCheckToken checks for a stored token, returning true if there is one
+func doctorCheckToken(r *doctorReport, store config.ConfigStore) bool {
+	tok := auth.FetchToken(store, monzo.TokenName)
+	if tok == nil {
+		r.fail("token", monzo.ErrNotLoggedIn, "run mzutil login")
+		return false
+	}
+
+	switch {
+	case tok.Valid() && tok.Expiry.IsZero():
+		r.pass("token", "valid, does not expire")
+	case tok.Valid():
+		r.pass("token", fmt.Sprintf("valid for %v", time.Until(tok.Expiry).Truncate(time.Second)))
+	case tok.RefreshToken != "":
+		r.pass("token", "expired, will be refreshed on next use")
+	default:
+		r.fail("token", errors.New("expired with no refresh token"), "run mzutil login")
+		return false
+	}
+
+	return true
+}
+
+// doctorCheckApi checks that the API accepts our token
+func doctorCheckApi(r *doctorReport, store config.ConfigStore) {
+	a, err := getAuthenticator(store)
+	if err != nil {
+		r.fail("api", err, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := monzo.NewClient(ctx, a)
+	if err != nil {
+		r.fail("api", err, "run mzutil login")
+		return
+	}
+
+	w, err := client.WhoAmI()
+	if err != nil {
+		r.fail("api", err, "check network access to api.monzo.com, or run mzutil login")
+		return
+	}
+
+	if !w.Authenticated {
+		r.fail("api", monzo.ErrAuthError, "run mzutil login")
+		return
+	}
+
+	r.pass("api", "authenticated as "+w.UserId)
+}
@@ -0,0 +1,239 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+
+	"github.com/char8/mzutil/daemon"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flag - address for `exporter` to serve metrics on
+var exporterListen string
+
+// set by flag - time between polls in `exporter`
+var exporterInterval time.Duration
+
+func init() {
+	exporterCmd.Flags().StringVar(&exporterListen, "listen", "127.0.0.1:9452",
+		"Address to serve /metrics on, e.g. :9452 for every interface")
+	exporterCmd.Flags().DurationVar(&exporterInterval, "interval", 5*time.Minute,
+		"Time between polls of balances and transactions")
+
+	rootCmd.AddCommand(exporterCmd)
+}
+
+var exporterCmd = &cobra.Command{
+	Use:   "exporter",
+	Short: "Serve balances and spending as Prometheus metrics",
+	Long: `Poll balances, pots and transactions every --interval and serve them as
+Prometheus gauges on /metrics, labelled by account and currency. Amounts are
+in major units, e.g. pounds. Scrapes are answered from the last poll, so they
+don't call the API.
+
+Requests to the API and token refreshes made by the exporter are counted too.`,
+	Args: cobra.NoArgs,
+	RunE: exporterRun,
+}
+
+// exporterHistory covers the transactions needed for month-to-date spend
+const exporterHistory = 31 * 24 * time.Hour
+
+// exporterMetrics are the metrics served by `exporter`
+type exporterMetrics struct {
+	reg *prometheus.Registry
+
+	// held while the gauges are updated and served, so that concurrent
+	// scrapes don't see each other's half updated gauges
+	mu sync.Mutex
+
+	balance      *prometheus.GaugeVec
+	totalBalance *prometheus.GaugeVec
+	potBalance   *prometheus.GaugeVec
+	spendToday   *prometheus.GaugeVec
+	spendMonth   *prometheus.GaugeVec
+	lastPoll     *prometheus.GaugeVec
+
+	requests  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	refreshes *prometheus.CounterVec
+}
+
+func newExporterMetrics() *exporterMetrics {
+	gauge := func(name, help string, labels ...string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	}
+
+	m := &exporterMetrics{
+		reg: prometheus.NewRegistry(),
+
+		balance: gauge("mzutil_balance",
+			"Balance of the account, excluding pots", "account", "currency"),
+		totalBalance: gauge("mzutil_total_balance",
+			"Balance of the account including pots", "account", "currency"),
+		potBalance: gauge("mzutil_pot_balance",
+			"Balance of a pot", "account", "pot_id", "pot", "currency"),
+		spendToday: gauge("mzutil_spend_today",
+			"Amount spent from the account today", "account", "currency"),
+		spendMonth: gauge("mzutil_spend_month",
+			"Amount spent from the account this calendar month, by category", "account", "category", "currency"),
+		// no labels, so there is no sample until the first successful poll
+		lastPoll: gauge("mzutil_last_poll_timestamp_seconds",
+			"Time of the last successful poll of the API"),
+
+		requests: counter("mzutil_api_requests_total",
+			"Requests made to the API, by path and HTTP status code or error", "path", "code"),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mzutil_api_request_duration_seconds",
+			Help:    "Time taken by requests to the API",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"path"}),
+		refreshes: counter("mzutil_token_refreshes_total",
+			"OAuth2 token refreshes, by result", "result"),
+	}
+
+	m.reg.MustRegister(m.balance, m.totalBalance, m.potBalance, m.spendToday, m.spendMonth, m.lastPoll,
+		m.requests, m.latency, m.refreshes)
+
+	m.refreshes.WithLabelValues("ok")
+	m.refreshes.WithLabelValues("error")
+	return m
+}
+
+func exporterRun(cmd *cobra.Command, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m := newExporterMetrics()
+
+	// the oauth2 package uses the client in the context for both API requests
+	// and token refreshes, so both are counted
+	hc := &http.Client{Transport: &instrumentedTransport{base: http.DefaultTransport, m: m}}
+	client, err := getClient(context.WithValue(ctx, oauth2.HTTPClient, hc))
+	if err != nil {
+		return err
+	}
+
+	s := daemon.NewServer(client, daemon.Options{
+		Interval: exporterInterval,
+		History:  exporterHistory,
+	})
+
+	l, err := net.Listen("tcp", exporterListen)
+	if err != nil {
+		return err
+	}
+
+	metricsHandler := promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.update(s.Snapshot(), time.Now())
+		metricsHandler.ServeHTTP(w, r)
+	})
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	go s.Run(ctx)
+
+	log.Infof("serving metrics on http://%v/metrics", l.Addr())
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// update sets the gauges from snap. They are reset first so that accounts
+// and pots that have gone away aren't reported. m.mu must be held.
+func (m *exporterMetrics) update(snap daemon.Snapshot, now time.Time) {
+	for _, g := range []*prometheus.GaugeVec{m.balance, m.totalBalance, m.potBalance, m.spendToday, m.spendMonth} {
+		g.Reset()
+	}
+
+	if !snap.Status.Updated.IsZero() {
+		m.lastPoll.WithLabelValues().Set(float64(snap.Status.Updated.Unix()))
+	}
+
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	for _, a := range snap.Accounts {
+		if b, ok := snap.Balances[a.Id]; ok {
+			m.balance.WithLabelValues(a.Id, b.Currency).Set(majorUnits(b.Balance))
+			m.totalBalance.WithLabelValues(a.Id, b.Currency).Set(majorUnits(b.TotalBalance))
+
+			// spend is reported by the API as a negative amount
+			m.spendToday.WithLabelValues(a.Id, b.Currency).Set(majorUnits(-b.SpendToday))
+		}
+
+		for _, p := range snap.Pots[a.Id] {
+			m.potBalance.WithLabelValues(a.Id, p.Id, p.Name, p.Currency).Set(majorUnits(p.Balance))
+		}
+
+		for _, t := range snap.Transactions[a.Id] {
+			if !t.IncludeInSpending || (t.DeclineReason != "") || t.Created.Before(monthStart) {
+				continue
+			}
+			m.spendMonth.WithLabelValues(a.Id, t.Category, t.Currency).Add(majorUnits(-t.Amount))
+		}
+	}
+}
+
+// majorUnits converts an amount in minor units, e.g. pence, to major units
+func majorUnits(amount int64) float64 {
+	return float64(amount) / 100.0
+}
+
+// instrumentedTransport counts requests and token refreshes in m
+type instrumentedTransport struct {
+	base http.RoundTripper
+	m    *exporterMetrics
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	t.m.requests.WithLabelValues(req.URL.Path, code).Inc()
+	t.m.latency.WithLabelValues(req.URL.Path).Observe(time.Since(start).Seconds())
+
+	if strings.HasPrefix(req.URL.String(), monzo.Provider.TokenURL) {
+		result := "ok"
+		if (err != nil) || (resp.StatusCode != http.StatusOK) {
+			result = "error"
+		}
+		t.m.refreshes.WithLabelValues(result).Inc()
+	}
+
+	return resp, err
+}
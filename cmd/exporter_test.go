@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/char8/mzutil/daemon"
+	"github.com/char8/mzutil/monzo"
+)
+
+// scrape returns the metrics page served by the exporter
+func scrape(t *testing.T, m *exporterMetrics) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func testSnapshot(now time.Time) daemon.Snapshot {
+	return daemon.Snapshot{
+		Status:   daemon.Status{Updated: time.Unix(1700000000, 0)},
+		Accounts: []monzo.AccountResponse{{Id: "acc_1"}},
+		Balances: map[string]monzo.BalanceResponse{
+			"acc_1": {Balance: 12345, TotalBalance: 22345, Currency: "GBP", SpendToday: -550},
+		},
+		Pots: map[string][]monzo.PotResponse{
+			"acc_1": {{Id: "pot_1", Name: "Rainy \"day\"", Balance: 10000, Currency: "GBP"}},
+		},
+		Transactions: map[string][]monzo.TransactionResponse{
+			"acc_1": {
+				{Id: "tx_1", Created: now.Add(-time.Hour), Amount: -1000, Currency: "GBP", Category: "groceries", IncludeInSpending: true},
+				{Id: "tx_2", Created: now.Add(-time.Hour), Amount: -500, Currency: "GBP", Category: "groceries", IncludeInSpending: true},
+				{Id: "tx_3", Created: now.Add(-time.Hour), Amount: -700, Currency: "GBP", Category: "eating_out", IncludeInSpending: true, DeclineReason: "INSUFFICIENT_FUNDS"},
+				{Id: "tx_4", Created: now.Add(-time.Hour), Amount: 5000, Currency: "GBP", Category: "general"},
+			},
+		},
+	}
+}
+
+func TestExporterUpdate(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	m := newExporterMetrics()
+	m.update(testSnapshot(now), now)
+
+	page := scrape(t, m)
+	for _, want := range []string{
+		`mzutil_balance{account="acc_1",currency="GBP"} 123.45`,
+		`mzutil_total_balance{account="acc_1",currency="GBP"} 223.45`,
+		`mzutil_pot_balance{account="acc_1",currency="GBP",pot="Rainy \"day\"",pot_id="pot_1"} 100`,
+		`mzutil_spend_today{account="acc_1",currency="GBP"} 5.5`,
+		`mzutil_spend_month{account="acc_1",category="groceries",currency="GBP"} 15`,
+		`mzutil_last_poll_timestamp_seconds 1.7e+09`,
+		`mzutil_token_refreshes_total{result="error"} 0`,
+		`# TYPE mzutil_balance gauge`,
+	} {
+		if !strings.Contains(page, want+"\n") {
+			t.Errorf("metrics page is missing %v\n%v", want, page)
+		}
+	}
+
+	// declined transactions and ones not counted as spending are left out
+	for _, unwanted := range []string{`category="eating_out"`, `category="general"`} {
+		if strings.Contains(page, unwanted) {
+			t.Errorf("metrics page has %v", unwanted)
+		}
+	}
+}
+
+func TestExporterUpdateDropsGoneSeries(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	m := newExporterMetrics()
+	m.update(testSnapshot(now), now)
+
+	// the pot is gone and the month has turned over
+	snap := testSnapshot(now)
+	snap.Pots = nil
+	next := now.AddDate(0, 1, 0)
+	m.update(snap, next)
+
+	page := scrape(t, m)
+	for _, unwanted := range []string{"mzutil_pot_balance{", "mzutil_spend_month{"} {
+		if strings.Contains(page, unwanted) {
+			t.Errorf("metrics page still has %v", unwanted)
+		}
+	}
+	if !strings.Contains(page, `mzutil_balance{account="acc_1",currency="GBP"} 123.45`) {
+		t.Errorf("metrics page lost the balance\n%v", page)
+	}
+}
+
+func TestExporterNoPollYet(t *testing.T) {
+	m := newExporterMetrics()
+	m.update(daemon.Snapshot{}, time.Now())
+
+	page := scrape(t, m)
+	if strings.Contains(page, "mzutil_last_poll_timestamp_seconds ") {
+		t.Errorf("metrics page reports a poll before there was one\n%v", page)
+	}
+}
@@ -2,15 +2,40 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
+	"github.com/char8/mzutil/auth"
+	"github.com/char8/mzutil/config"
 	"github.com/char8/mzutil/monzo"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// set by flags - how to get the authorization code on login
+var loginNoBrowser, loginManual bool
+
+// set by flag - template file for the page shown after the callback
+var loginPageTemplate string
+
+// set by flag - also remove the auth config on logout
+var logoutAll bool
+
 func init() {
+	loginCmd.Flags().BoolVar(&loginNoBrowser, "no-browser", false,
+		"Don't open a browser, print the auth URL instead")
+	loginCmd.Flags().StringVar(&loginPageTemplate, "page-template", "",
+		"html/template file for the page shown in the browser after login (default "+monzo.CallbackPageFile+" in the config dir, if present)")
+	loginCmd.Flags().BoolVar(&loginManual, "manual", false,
+		"Don't run the callback server, paste the redirected URL on stdin instead")
+
+	logoutCmd.Flags().BoolVar(&logoutAll, "all", false,
+		"Also remove the stored OAuth2 client configuration")
+
 	rootCmd.AddCommand(loginCmd)
 	rootCmd.AddCommand(logoutCmd)
 }
@@ -18,54 +43,123 @@ func init() {
 var loginCmd = &cobra.Command{
 	Use:   "login",
 	Short: "Login to monzo using OAuth2",
-	Args:  cobra.NoArgs,
-	RunE:  loginRun,
+	Long: `Login to monzo using OAuth2. The auth URL is opened in a browser and a
+server on the callback URL waits for the redirect.
+
+Over SSH, where neither works, use:
+
+  mzutil login --no-browser --manual
+
+then open the printed URL on any machine and paste back the URL you are
+redirected to, in full, as its state is checked. The page itself doesn't
+need to load.
+
+https://localhost callback URLs are served with a self-signed certificate,
+kept in the store, unless setup was given --tls-cert-file and --tls-key-file.`,
+	Args: cobra.NoArgs,
+	RunE: loginRun,
 }
 
 var logoutCmd = &cobra.Command{
 	Use:   "logout",
 	Short: "Logout from Monzo",
+	Long:  `Revoke the OAuth2 token and delete it from storage`,
 	Args:  cobra.NoArgs,
 	RunE:  logoutRun,
 }
 
 func loginRun(cmd *cobra.Command, args []string) error {
-	store := getConfigStore()
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := getAuthenticator(store)
+	if err != nil {
+		return err
+	}
+
+	// cancel the login on Ctrl-C, rather than leave the server running
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	auth, err := monzo.NewAuthenticator(store)
+	dirs, err := getDirs()
 	if err != nil {
 		return err
 	}
 
-	err = auth.Login()
+	// the certificate goes in the cache dir, as the store dirs may only
+	// hold private files
+	err = a.Login(ctx, auth.LoginOptions{
+		NoBrowser:    loginNoBrowser,
+		Manual:       loginManual,
+		Input:        os.Stdin,
+		Output:       os.Stderr,
+		CertFile:     filepath.Join(dirs.Cache, monzo.CallbackCertFile),
+		PageTemplate: loginPage(dirs),
+	})
 
 	if err != nil {
 		return err
 	}
 
-	client := monzo.NewClient(context.Background(), auth)
+	client, err := monzo.NewClient(context.Background(), a)
+	if err != nil {
+		return err
+	}
+
 	w, err := client.WhoAmI()
 
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Server response is: %+v", w)
+	fmt.Printf("Server response is: %+v\n", w)
 	return nil
 }
 
-func logoutRun(cmd *cobra.Command, args []string) error {
-	client, err := getClient(context.Background())
+// loginPage returns the callback page template set by --page-template, or the
+// one in the config dir if there is one
+func loginPage(dirs config.Dirs) string {
+	if loginPageTemplate != "" {
+		return loginPageTemplate
+	}
+
+	p := filepath.Join(dirs.Config, monzo.CallbackPageFile)
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
 
+	return ""
+}
+
+func logoutRun(cmd *cobra.Command, args []string) error {
+	store, err := getConfigStore()
 	if err != nil {
 		return err
 	}
 
-	h := client.HttpClient()
-	_, err = h.PostForm(monzo.MonzoLogoutUrl, url.Values{})
-	if err != nil {
-		log.WithError(err).Error("logout error")
+	a, err := getAuthenticator(store)
+	if err == nil {
+		err = a.Logout(context.Background())
+	} else {
+		// the token can't be revoked without the auth config, but it can
+		// still be deleted
+		log.WithError(err).Warn("could not load the auth config, deleting the token without revoking it")
+		err = auth.DeleteToken(store, monzo.TokenName)
 	}
-	return err
 
+	if logoutAll {
+		// there being no token doesn't stop the config from being removed
+		if errors.Is(err, monzo.ErrNotLoggedIn) {
+			err = nil
+		}
+
+		cerr := store.DeleteValue(monzo.AuthConfigKey)
+		if (cerr != nil) && (cerr != config.ErrNoConfig) && (err == nil) {
+			err = cerr
+		}
+	}
+
+	return err
 }
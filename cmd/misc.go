@@ -2,32 +2,35 @@ package cmd
 
 import (
 	"context"
+	"path/filepath"
 
+	"github.com/char8/mzutil/auth"
 	"github.com/char8/mzutil/config"
 	"github.com/char8/mzutil/monzo"
 )
 
 func getClient(ctx context.Context) (*monzo.Client, error) {
-	store := getConfigStore()
-
-	auth, err := monzo.NewAuthenticator(store)
+	store, err := getConfigStore()
 	if err != nil {
 		return nil, err
 	}
 
-	client := monzo.NewClient(ctx, auth)
+	auth, err := getAuthenticator(store)
+	if err != nil {
+		return nil, err
+	}
 
-	return client, nil
+	return monzo.NewClient(ctx, auth)
 }
 
-func getConfigStore() config.ConfigStore {
-	var store config.ConfigStore
-
-	if useFileStore {
-		store = config.NewFileConfigStore(monzo.FileStoreDir)
-	} else {
-		store = config.NewKeychainConfigStore(monzo.KeychainServiceName)
+// getAuthenticator returns the monzo Authenticator for store, with token
+// refreshes locked by a file in the data dir
+func getAuthenticator(store config.ConfigStore) (auth.Authenticator, error) {
+	dirs, err := getDirs()
+	if err != nil {
+		return nil, err
 	}
 
-	return store
+	lock := config.NewFileLock(filepath.Join(dirs.Data, monzo.TokenName+".lock"))
+	return monzo.NewAuthenticator(store, lock)
 }
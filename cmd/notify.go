@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+var ErrNoNotifier = errors.New("no desktop notification command found")
+
+// desktopNotify shows a desktop notification with notify-send on Linux or
+// osascript on macOS
+func desktopNotify(summary, body string) error {
+	var c *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		c = exec.Command("osascript", "-e",
+			fmt.Sprintf("display notification %q with title %q", body, summary))
+	default:
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return ErrNoNotifier
+		}
+		c = exec.Command("notify-send", "--app-name=mzutil", "--urgency=critical", summary, body)
+	}
+
+	return c.Run()
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/char8/mzutil/monzo"
+)
+
+var ErrNoPassphrase = errors.New("no passphrase: set " + monzo.PassphraseEnv +
+	", use --passphrase-fd or run in a terminal")
+
+// readPassphrase gets the encrypted store passphrase from the environment,
+// the file descriptor set with --passphrase-fd or, failing those, a prompt
+// on the terminal.
+func readPassphrase() ([]byte, error) {
+	if p, ok := os.LookupEnv(monzo.PassphraseEnv); ok {
+		return []byte(p), nil
+	}
+
+	if passphraseFd >= 0 {
+		f := os.NewFile(uintptr(passphraseFd), "passphrase-fd")
+		if f == nil {
+			return nil, fmt.Errorf("bad passphrase file descriptor %v", passphraseFd)
+		}
+
+		defer f.Close()
+
+		// only the first line is used so that `echo` or a heredoc can be used
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if (err != nil) && (line == "") {
+			return nil, err
+		}
+
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, ErrNoPassphrase
+	}
+
+	fmt.Fprint(os.Stderr, "Store passphrase: ")
+	p, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	return p, err
+}
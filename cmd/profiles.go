@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/spf13/cobra"
+
+	"github.com/char8/mzutil/config"
+	"github.com/char8/mzutil/monzo"
+)
+
+// profilesKey is the key of the profile registry in the profiles dir
+const profilesKey = "profiles"
+
+func init() {
+	profilesCmd.AddCommand(profilesListCmd)
+	profilesCmd.AddCommand(profilesAddCmd)
+	profilesCmd.AddCommand(profilesRemoveCmd)
+	profilesCmd.AddCommand(profilesSetDefaultCmd)
+	rootCmd.AddCommand(profilesCmd)
+}
+
+var profilesCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "Manage profiles for several logins or OAuth clients",
+	Long: `Each profile has its own auth config and token. Select a profile with
+--profile or $MZUTIL_PROFILE, otherwise the default profile is used.`,
+	Args: cobra.NoArgs,
+	RunE: profilesListRun,
+}
+
+var profilesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List profiles",
+	Args:  cobra.NoArgs,
+	RunE:  profilesListRun,
+}
+
+var profilesAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Add a profile, then run setup and login with --profile",
+	Args:  cobra.ExactArgs(1),
+	RunE:  profilesAddRun,
+}
+
+var profilesRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Remove a profile and delete its stored config and token",
+	Args:  cobra.ExactArgs(1),
+	RunE:  profilesRemoveRun,
+}
+
+var profilesSetDefaultCmd = &cobra.Command{
+	Use:   "set-default <name>",
+	Short: "Use a profile when --profile isn't given",
+	Args:  cobra.ExactArgs(1),
+	RunE:  profilesSetDefaultRun,
+}
+
+var ErrBadProfileName = errors.New("profile names must be lower case letters, digits, - and _")
+var ErrRemoveDefaultProfile = errors.New("the default profile can't be removed")
+
+var profileNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// profileRegistry records the profiles that have been added
+type profileRegistry struct {
+	Default  string   `json:"default"`
+	Profiles []string `json:"profiles"`
+}
+
+func (r *profileRegistry) has(name string) bool {
+	if name == monzo.DefaultProfile {
+		return true
+	}
+
+	for _, p := range r.Profiles {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// registryStore returns the store holding the profile registry, which is
+// a plain file in the base config dir whatever --store is
+func registryStore() (config.ConfigStore, error) {
+	d, err := getBaseDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	return config.NewFileConfigStore(filepath.Join(d.Config, monzo.ProfilesDir)), nil
+}
+
+func readRegistry() (profileRegistry, error) {
+	var r profileRegistry
+
+	store, err := registryStore()
+	if err != nil {
+		return r, err
+	}
+
+	err = store.ReadValue(profilesKey, &r)
+	if err == config.ErrNoConfig {
+		err = nil
+	}
+
+	if r.Default == "" {
+		r.Default = monzo.DefaultProfile
+	}
+
+	return r, err
+}
+
+func writeRegistry(r profileRegistry) error {
+	store, err := registryStore()
+	if err != nil {
+		return err
+	}
+
+	return store.WriteValue(profilesKey, &r)
+}
+
+// currentProfile returns the profile set by --profile, $MZUTIL_PROFILE or
+// set-default, in that order
+func currentProfile() (string, error) {
+	name := profileName
+	if name == "" {
+		name = os.Getenv(monzo.ProfileEnv)
+	}
+
+	r, err := readRegistry()
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		name = r.Default
+	}
+
+	if !r.has(name) {
+		return "", fmt.Errorf("unknown profile %q, add it with `mzutil profiles add %v`", name, name)
+	}
+
+	return name, nil
+}
+
+func profilesListRun(cmd *cobra.Command, args []string) error {
+	r, err := readRegistry()
+	if err != nil {
+		return err
+	}
+
+	current, err := currentProfile()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range append([]string{monzo.DefaultProfile}, r.Profiles...) {
+		mark := " "
+		if p == current {
+			mark = "*"
+		}
+
+		if p == r.Default {
+			fmt.Printf("%v %v (default)\n", mark, p)
+		} else {
+			fmt.Printf("%v %v\n", mark, p)
+		}
+	}
+
+	return nil
+}
+
+func profilesAddRun(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if !profileNameRe.MatchString(name) {
+		return ErrBadProfileName
+	}
+
+	r, err := readRegistry()
+	if err != nil {
+		return err
+	}
+
+	if r.has(name) {
+		return fmt.Errorf("profile %q already exists", name)
+	}
+
+	r.Profiles = append(r.Profiles, name)
+	err = writeRegistry(r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added profile %v, now run:\n", name)
+	fmt.Printf("\tmzutil --profile %v setup\n", name)
+	fmt.Printf("\tmzutil --profile %v login\n", name)
+	return nil
+}
+
+func profilesRemoveRun(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if name == monzo.DefaultProfile {
+		return ErrRemoveDefaultProfile
+	}
+
+	r, err := readRegistry()
+	if err != nil {
+		return err
+	}
+
+	if !r.has(name) {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	// delete the profile's values first, so a failure leaves it listed
+	store, err := openStores(getStoreSpecs(), name)
+	if err != nil {
+		return err
+	}
+
+	keys, err := migrateKeys(store)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := store.DeleteValue(key)
+		if (err != nil) && (err != config.ErrNoConfig) && (err != config.ErrReadOnly) {
+			return fmt.Errorf("deleting %v: %v", key, err)
+		}
+	}
+
+	profiles := r.Profiles[:0]
+	for _, p := range r.Profiles {
+		if p != name {
+			profiles = append(profiles, p)
+		}
+	}
+	r.Profiles = profiles
+
+	if r.Default == name {
+		r.Default = monzo.DefaultProfile
+	}
+
+	err = writeRegistry(r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed profile %v from %v\n", name, store)
+	return nil
+}
+
+func profilesSetDefaultRun(cmd *cobra.Command, args []string) error {
+	name := args[0]
+
+	r, err := readRegistry()
+	if err != nil {
+		return err
+	}
+
+	if !r.has(name) {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+
+	r.Default = name
+	return writeRegistry(r)
+}
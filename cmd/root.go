@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -8,12 +9,38 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// set by flag - uses filestore instead of keystore
+// set by flag - selects the ConfigStore backends, see getConfigStore
+var storeSpecs []string
+
+// set by deprecated flags - use file/encrypted store, superseded by --store
 var useFileStore bool
+var useEncryptedStore bool
+
+// set by flag - file descriptor to read the encrypted store passphrase from
+var passphraseFd int
+
+// set by flag - directory for config, tokens and cache instead of XDG dirs
+var configDir string
+
+// set by flag - profile to use instead of the default, see currentProfile
+var profileName string
 
 func init() {
+	rootCmd.PersistentFlags().StringArrayVarP(&storeSpecs, "store", "s", []string{"keychain:"},
+		"Secret storage URI: keychain:, file:[path], encrypted:[path], pass:[prefix], exec:<commands.json>, env:[prefix], json:<path>, stdout:[prefix] or mem:. Repeat to layer stores")
 	rootCmd.PersistentFlags().BoolVarP(&useFileStore, "filestore", "f", false,
 		"Use files for secret storage instead of the login keychain")
+	rootCmd.PersistentFlags().BoolVarP(&useEncryptedStore, "encrypted", "e", false,
+		"Use passphrase encrypted files for secret storage instead of the login keychain")
+	rootCmd.PersistentFlags().IntVar(&passphraseFd, "passphrase-fd", -1,
+		"Read the encrypted store passphrase from this file descriptor")
+	rootCmd.PersistentFlags().StringVarP(&profileName, "profile", "p", "",
+		"Profile to use (default set by profiles set-default, or $MZUTIL_PROFILE)")
+	rootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "",
+		"Keep config, tokens and cache in this directory (default XDG base dirs, or $MZUTIL_CONFIG_DIR)")
+
+	rootCmd.PersistentFlags().MarkDeprecated("filestore", "use --store file")
+	rootCmd.PersistentFlags().MarkDeprecated("encrypted", "use --store encrypted")
 }
 
 var rootCmd = &cobra.Command{
@@ -32,7 +59,8 @@ func Execute() {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v", err)
 
-		if cerr, ok := err.(*monzo.ClientError); ok {
+		var cerr *monzo.ClientError
+		if errors.As(err, &cerr) {
 			os.Exit(cerr.ExitCode())
 		}
 
@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/char8/mzutil/config"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flag - directory to write the systemd units to
+var serviceDir string
+
+// set by flag - also write a .socket unit to start the daemon on first use
+var serviceSocket bool
+
+// set by flag - time between daemon polls in the service unit
+var serviceInterval time.Duration
+
+// set by flag - time between runs of the keepalive timer
+var serviceKeepalive time.Duration
+
+// set by flag - time between runs of the sync timer
+var serviceSync time.Duration
+
+// set by flags - print the units instead of writing them, overwrite
+// existing units
+var serviceDryRun, serviceForce bool
+
+func init() {
+	installServiceCmd.Flags().StringVar(&serviceDir, "dir", "",
+		"Write the units to this directory (default $XDG_CONFIG_HOME/systemd/user)")
+	installServiceCmd.Flags().BoolVar(&serviceSocket, "socket", false,
+		"Also write a socket unit, so that systemd starts the daemon when it is first used")
+	installServiceCmd.Flags().DurationVar(&serviceInterval, "interval", 5*time.Minute,
+		"Time between polls of balances and transactions by the daemon")
+	installServiceCmd.Flags().DurationVar(&serviceKeepalive, "keepalive-every", 30*time.Minute,
+		"Time between runs of mzutil token keepalive by the timer")
+	installServiceCmd.Flags().DurationVar(&serviceSync, "sync-every", time.Hour,
+		"Time between runs of mzutil sync by the sync timer")
+	installServiceCmd.Flags().BoolVar(&serviceDryRun, "dry-run", false,
+		"Print the units instead of writing them")
+	installServiceCmd.Flags().BoolVar(&serviceForce, "force", false,
+		"Overwrite existing units")
+
+	rootCmd.AddCommand(installServiceCmd)
+}
+
+var installServiceCmd = &cobra.Command{
+	Use:   "install-service",
+	Short: "Write systemd user units for the daemon, sync and token keepalive",
+	Long: `Write systemd user units that run mzutil daemon, a timer that runs mzutil
+sync every --sync-every, and a timer that runs mzutil token keepalive so the
+token is refreshed while the daemon is stopped. With --socket, a socket unit
+starts the daemon when a command first uses it.
+
+The daemon polls the API itself, so enable either it or the sync timer. The
+sync timer suits machines that don't keep the daemon running.
+
+The units use the same --store, --profile and --config-dir as this command,
+so credentials come from the configured store. Environment variables for the
+units, e.g. MZUTIL_PASSPHRASE for the encrypted store, can be set in
+` + monzo.ServiceDir + `/` + monzo.ServiceEnvFile + ` in the config dir. It is created, readable only by
+you, if it doesn't exist.`,
+	Args: cobra.NoArgs,
+	RunE: installServiceRun,
+}
+
+var ErrServiceExists = errors.New("systemd unit already exists, use --force to overwrite")
+var ErrServiceStore = errors.New("the mem: and stdout: stores can't be used by a service")
+
+// serviceUnits are the templates of the units written by install-service,
+// by name without the profile suffix
+var serviceUnits = []struct {
+	name   string
+	socket bool // only written with --socket
+	tmpl   *template.Template
+}{
+	{"mzutil-daemon.service", false, template.Must(template.New("").Parse(`[Unit]
+Description=mzutil daemon ({{.Profile}} profile)
+Documentation=https://github.com/char8/mzutil
+{{- if .Socket}}
+Requires={{.Name "mzutil-daemon.socket"}}
+After={{.Name "mzutil-daemon.socket"}}
+{{- end}}
+
+[Service]
+Type=simple
+ExecStart={{.Exec "daemon" "--interval" .Interval}}
+EnvironmentFile=-{{.EnvFile}}
+Restart=on-failure
+RestartSec=30
+
+[Install]
+WantedBy=default.target
+`))},
+	{"mzutil-daemon.socket", true, template.Must(template.New("").Parse(`[Unit]
+Description=mzutil daemon socket ({{.Profile}} profile)
+
+[Socket]
+ListenStream={{.SocketPath}}
+SocketMode=0600
+DirectoryMode=0700
+RemoveOnStop=yes
+
+[Install]
+WantedBy=sockets.target
+`))},
+	{"mzutil-sync.service", false, template.Must(template.New("").Parse(`[Unit]
+Description=Fetch mzutil balances and transactions ({{.Profile}} profile)
+
+[Service]
+Type=oneshot
+ExecStart={{.Exec "sync"}}
+EnvironmentFile=-{{.EnvFile}}
+`))},
+	{"mzutil-sync.timer", false, template.Must(template.New("").Parse(`[Unit]
+Description=Fetch mzutil balances and transactions ({{.Profile}} profile)
+
+[Timer]
+OnBootSec=5min
+OnUnitActiveSec={{.Sync}}
+Unit={{.Name "mzutil-sync.service"}}
+
+[Install]
+WantedBy=timers.target
+`))},
+	{"mzutil-keepalive.service", false, template.Must(template.New("").Parse(`[Unit]
+Description=Refresh the mzutil OAuth2 token ({{.Profile}} profile)
+
+[Service]
+Type=oneshot
+ExecStart={{.Exec "token" "keepalive" "--notify" "--within" .Within}}
+EnvironmentFile=-{{.EnvFile}}
+`))},
+	{"mzutil-keepalive.timer", false, template.Must(template.New("").Parse(`[Unit]
+Description=Refresh the mzutil OAuth2 token ({{.Profile}} profile)
+
+[Timer]
+OnBootSec=2min
+OnUnitActiveSec={{.Keepalive}}
+Unit={{.Name "mzutil-keepalive.service"}}
+
+[Install]
+WantedBy=timers.target
+`))},
+}
+
+// serviceData is passed to the serviceUnits templates
+type serviceData struct {
+	Profile    string
+	Socket     bool
+	SocketPath string
+	EnvFile    string
+	Interval   string
+	Within     string
+	Keepalive  string
+	Sync       string
+
+	args    []string // global flags for every mzutil command
+	envPath string   // EnvFile before escaping
+}
+
+// Name returns the unit name for the profile
+func (d serviceData) Name(unit string) string {
+	return serviceUnitName(unit, d.Profile)
+}
+
+// Exec returns an ExecStart command line running mzutil with args
+func (d serviceData) Exec(args ...string) string {
+	all := append(append([]string{}, d.args...), args...)
+
+	quoted := make([]string, 0, len(all))
+	for _, a := range all {
+		quoted = append(quoted, systemdQuote(a))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func installServiceRun(cmd *cobra.Command, args []string) error {
+	data, err := getServiceData()
+	if err != nil {
+		return err
+	}
+
+	// fail now rather than when the service starts
+	err = checkServiceLogin()
+	if err != nil {
+		return err
+	}
+
+	dir := serviceDir
+	if dir == "" {
+		d, err := config.XDGDirs("systemd")
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(d.Config, "user")
+	}
+
+	for _, u := range serviceUnits {
+		if u.socket && !serviceSocket {
+			continue
+		}
+
+		var b bytes.Buffer
+		err := u.tmpl.Execute(&b, data)
+		if err != nil {
+			return err
+		}
+
+		name := data.Name(u.name)
+
+		if serviceDryRun {
+			fmt.Printf("# %v\n%v\n", filepath.Join(dir, name), b.String())
+			continue
+		}
+
+		err = writeUnit(filepath.Join(dir, name), b.Bytes())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %v\n", filepath.Join(dir, name))
+	}
+
+	if serviceDryRun {
+		fmt.Printf("# %v would be created if missing\n", data.envPath)
+		return nil
+	}
+
+	err = writeEnvFile(data.envPath)
+	if err != nil {
+		return err
+	}
+
+	start := data.Name("mzutil-daemon.service")
+	if serviceSocket {
+		start = data.Name("mzutil-daemon.socket")
+	}
+
+	fmt.Println()
+	fmt.Println("Start them with:")
+	fmt.Println("  systemctl --user daemon-reload")
+	fmt.Printf("  systemctl --user enable --now %v %v\n", start, data.Name("mzutil-keepalive.timer"))
+	fmt.Println("or, without the daemon:")
+	fmt.Printf("  systemctl --user enable --now %v %v\n", data.Name("mzutil-sync.timer"), data.Name("mzutil-keepalive.timer"))
+	return nil
+}
+
+// getServiceData returns the values for the units of the current profile
+func getServiceData() (serviceData, error) {
+	var d serviceData
+
+	profile, err := currentProfile()
+	if err != nil {
+		return d, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return d, err
+	}
+
+	d.args = []string{exe}
+	for _, spec := range getStoreSpecs() {
+		switch {
+		case strings.HasPrefix(spec, "mem"), strings.HasPrefix(spec, "stdout"):
+			return d, ErrServiceStore
+		case strings.HasPrefix(spec, "encrypted"):
+			log.Warnf("the encrypted store needs %v, set it in the units' environment file", monzo.PassphraseEnv)
+		}
+		d.args = append(d.args, "--store", spec)
+	}
+
+	// the config dir is resolved now, the service may have a different cwd
+	dir := configDir
+	if dir == "" {
+		dir = os.Getenv(monzo.ConfigDirEnv)
+	}
+	if dir != "" {
+		p, err := storePath(dir)
+		if err != nil {
+			return d, err
+		}
+		d.args = append(d.args, "--config-dir", p)
+	}
+
+	d.args = append(d.args, "--profile", profile)
+
+	dirs, err := profileDirs(profile)
+	if err != nil {
+		return d, err
+	}
+
+	socket, err := daemonSocket()
+	if err != nil {
+		return d, err
+	}
+
+	d.Profile = profile
+	d.Socket = serviceSocket
+	d.SocketPath = systemdEscape(socket)
+	// the environment file is kept out of the store dirs, in a subdir
+	d.envPath = filepath.Join(dirs.Config, monzo.ServiceDir, monzo.ServiceEnvFile)
+	d.EnvFile = systemdEscape(d.envPath)
+	d.Interval = serviceInterval.String()
+	d.Within = (2 * serviceKeepalive).String()
+	d.Keepalive = fmt.Sprintf("%ds", int(serviceKeepalive.Seconds()))
+	d.Sync = fmt.Sprintf("%ds", int(serviceSync.Seconds()))
+	return d, nil
+}
+
+// checkServiceLogin checks that the store has an auth config, and warns if
+// a login is needed before the units can work
+func checkServiceLogin() error {
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := getAuthenticator(store)
+	if err != nil {
+		return err
+	}
+
+	s, err := a.Status(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if s.NeedsLogin() {
+		log.Warn("run mzutil login before starting the units")
+	}
+
+	return nil
+}
+
+// writeUnit writes a unit file, refusing to overwrite one without --force
+func writeUnit(path string, b []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !serviceForce {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %v", ErrServiceExists, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// serviceEnvTemplate is written to a new environment file for the units
+const serviceEnvTemplate = `# Environment for the mzutil systemd units, e.g.
+# ` + monzo.PassphraseEnv + `=...
+`
+
+// writeEnvFile creates the environment file for the units, readable only by
+// the user as it may hold secrets. An existing file is left alone, but a
+// warning is logged if others can read it.
+func writeEnvFile(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), config.DirPerms)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, config.FilePerms)
+	if os.IsExist(err) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if stat.Mode().Perm() != config.FilePerms {
+			log.Warnf("%v has permissions %#o, should be %#o", path, stat.Mode().Perm(), config.FilePerms)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(serviceEnvTemplate)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %v\n", path)
+	return nil
+}
+
+// serviceUnitName returns the name of unit for profile, units of profiles
+// other than the default get the profile name added
+func serviceUnitName(unit, profile string) string {
+	if profile == monzo.DefaultProfile {
+		return unit
+	}
+
+	ext := filepath.Ext(unit)
+	return strings.TrimSuffix(unit, ext) + "-" + profile + ext
+}
+
+// systemdEscape escapes specifiers in a value of a unit file
+func systemdEscape(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// systemdQuote quotes an argument for an ExecStart line
+func systemdQuote(s string) string {
+	s = strings.Replace(systemdEscape(s), "$", "$$", -1)
+	if !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -4,80 +4,247 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/char8/mzutil/auth"
 	"github.com/char8/mzutil/config"
 	"github.com/char8/mzutil/monzo"
 )
 
+// set by flags - config values for non-interactive setup
+var setupClientId, setupClientSecretFile, setupCallbackUrl string
+
+// set by flags - certificate for https callbacks instead of a self-signed one
+var setupTlsCertFile, setupTlsKeyFile string
+
+// set by flag - how long before expiry to refresh the token
+var setupRefreshAhead time.Duration
+
+// set by flag - turn off PKCE for login
+var setupNoPkce bool
+
+// set by flag - print the config instead of writing it
+var setupDryRun bool
+
 func init() {
+	setupCmd.Flags().StringVar(&setupClientId, "client-id", "",
+		"OAuth2 client id (default $MZUTIL_CLIENT_ID)")
+	setupCmd.Flags().StringVar(&setupClientSecretFile, "client-secret-file", "",
+		"Read the OAuth2 client secret from this file, - for stdin (default $MZUTIL_CLIENT_SECRET)")
+	setupCmd.Flags().StringVar(&setupCallbackUrl, "callback-url", "",
+		"OAuth2 callback URL, e.g. http://localhost:8080/callback (default $MZUTIL_CALLBACK_URL)")
+	setupCmd.Flags().StringVar(&setupTlsCertFile, "tls-cert-file", "",
+		"PEM certificate for an https callback URL (default self-signed)")
+	setupCmd.Flags().StringVar(&setupTlsKeyFile, "tls-key-file", "",
+		"PEM private key for --tls-cert-file")
+	setupCmd.Flags().DurationVar(&setupRefreshAhead, "refresh-ahead", 0,
+		"Refresh the token this long before it expires (default 5m)")
+	setupCmd.Flags().BoolVar(&setupNoPkce, "no-pkce", false,
+		"Don't use PKCE on login, for OAuth clients that reject it")
+	setupCmd.Flags().BoolVar(&setupDryRun, "dry-run", false,
+		"Show the config that would be written without writing it")
+
 	rootCmd.AddCommand(setupCmd)
 }
 
 var setupCmd = &cobra.Command{
 	Use:   "setup",
 	Short: "Setup mzutil",
-	Long:  `Configure monzo secrets and the OAuth callback URL for mzutil`,
-	Args:  cobra.NoArgs,
-	RunE:  setupRun,
+	Long: `Configure monzo secrets and the OAuth callback URL for mzutil.
+
+Values not given by flags or environment variables are prompted for, which
+needs a terminal. If every value is given, an existing config is overwritten
+without asking.`,
+	Args: cobra.NoArgs,
+	RunE: setupRun,
 }
 
 var ErrNotTerminal = errors.New("not attached to an interactive terminal")
 
+// stdin is shared by prompts so that buffered input isn't lost between them
+var stdin = bufio.NewReader(os.Stdin)
+
 func setupRun(cmd *cobra.Command, args []string) error {
-	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
-		return ErrNotTerminal
+	var ac monzo.AuthConfig
+	var err error
+
+	ac.ClientId = setupValue(setupClientId, monzo.EnvPrefix+"CLIENT_ID")
+	ac.CallbackUrl = setupValue(setupCallbackUrl, monzo.EnvPrefix+"CALLBACK_URL")
+	ac.ClientSecret = os.Getenv(monzo.EnvPrefix + "CLIENT_SECRET")
+
+	ac.TlsCertFile, err = setupPath(setupTlsCertFile)
+	if err != nil {
+		return err
+	}
+
+	ac.TlsKeyFile, err = setupPath(setupTlsKeyFile)
+	if err != nil {
+		return err
+	}
+
+	if setupRefreshAhead != 0 {
+		ac.RefreshAhead = setupRefreshAhead.String()
+	}
+
+	if setupNoPkce {
+		pkce := false
+		ac.Pkce = &pkce
+	}
+
+	if setupClientSecretFile != "" {
+		ac.ClientSecret, err = readSecretFile(setupClientSecretFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check what we were given before prompting for the rest
+	if (ac.TlsCertFile == "") != (ac.TlsKeyFile == "") {
+		return errors.New("--tls-cert-file and --tls-key-file must be given together")
+	}
+
+	if ac.CallbackUrl != "" {
+		err = auth.ValidateCallbackUrl(ac.CallbackUrl)
+		if err != nil {
+			return err
+		}
+	}
+
+	interactive := (ac.ClientId == "") || (ac.ClientSecret == "") || (ac.CallbackUrl == "")
+	if interactive && !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("%v: pass --client-id, --client-secret-file and --callback-url", ErrNotTerminal)
 	}
 
 	// Get the current config
-	store := getConfigStore()
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Storing secrets in %v\n", store)
 
-	var ac monzo.AuthConfig
+	var existing monzo.AuthConfig
 	fmt.Printf("Looking for existing config with key %v\n", monzo.AuthConfigKey)
 
-	err := store.ReadValue(monzo.AuthConfigKey, &ac)
+	err = store.ReadValue(monzo.AuthConfigKey, &existing)
 
-	if err == nil {
+	switch {
+	case err == config.ErrNoConfig:
+		fmt.Println("No config found...")
+	case err != nil:
+		return err
+	case interactive:
 		fmt.Println("Found existing configuration:")
-		printConfig(ac)
+		printConfig(existing)
 
 		text, _ := getUserInput("Overwrite this config (Y/n)?")
-		if strings.HasPrefix(text, "n") {
+		if strings.HasPrefix(strings.ToLower(text), "n") {
 			fmt.Println("Leaving config unchanged")
-			os.Exit(0)
+			return nil
 		}
-	} else {
-		log.Printf("Err: %v", err)
 	}
 
-	if err == config.ErrNoConfig {
-		fmt.Println("No config found...")
-	}
-
-	ac.ClientId, _ = getUserInput("Enter Client Id:")
-	ac.ClientSecret, _ = getUserInput("Enter Client Secret:")
-	ac.CallbackUrl, err = getUserInput("Enter Callback URL:")
-
+	err = promptSetupValues(&ac)
 	if err != nil {
 		return err
 	}
 
+	if setupDryRun {
+		fmt.Println("Dry run, not writing:")
+		printConfig(ac)
+		return nil
+	}
+
 	fmt.Println("Writing to storage...")
 	err = store.WriteValue(monzo.AuthConfigKey, &ac)
 	return err
 }
 
+// setupValue returns flag if it is set, otherwise the environment variable env
+func setupValue(flag, env string) string {
+	if flag != "" {
+		return flag
+	}
+	return os.Getenv(env)
+}
+
+// setupPath makes path absolute, as login may run from another directory
+func setupPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
+
+// readSecretFile returns the first line of the file at path, or of stdin if
+// path is -
+func readSecretFile(path string) (string, error) {
+	var b []byte
+	var err error
+
+	if path == "-" {
+		b, err = ioutil.ReadAll(stdin)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+	if secret == "" {
+		return "", fmt.Errorf("no client secret in %v", path)
+	}
+
+	return secret, nil
+}
+
+// promptSetupValues prompts for any values missing from ac, asking again
+// until each is valid
+func promptSetupValues(ac *monzo.AuthConfig) error {
+	var err error
+
+	for ac.ClientId == "" {
+		ac.ClientId, err = getUserInput("Enter Client Id:")
+		if err != nil {
+			return err
+		}
+	}
+
+	for ac.ClientSecret == "" {
+		ac.ClientSecret, err = getHiddenInput("Enter Client Secret:")
+		if err != nil {
+			return err
+		}
+	}
+
+	for ac.CallbackUrl == "" {
+		ac.CallbackUrl, err = getUserInput("Enter Callback URL:")
+		if err != nil {
+			return err
+		}
+
+		verr := auth.ValidateCallbackUrl(ac.CallbackUrl)
+		if verr != nil {
+			fmt.Println(verr)
+			ac.CallbackUrl = ""
+		}
+	}
+
+	return ac.Validate()
+}
+
 func getUserInput(prompt string) (string, error) {
 	fmt.Println(prompt)
-	reader := bufio.NewReader(os.Stdin)
-	text, err := reader.ReadString('\n')
+	text, err := stdin.ReadString('\n')
 	if err != nil {
 		return "", err
 	}
@@ -86,13 +253,30 @@ func getUserInput(prompt string) (string, error) {
 	return text, nil
 }
 
+// getHiddenInput prompts for a value without echoing it to the terminal
+func getHiddenInput(prompt string) (string, error) {
+	fmt.Println(prompt)
+	b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
 func printConfig(c monzo.AuthConfig) {
 	fmt.Printf("\tClient ID: %v\n", c.ClientId)
 	if len(c.ClientSecret) > 10 {
 		fmt.Printf("\tClient Secret: %v...%v\n", c.ClientSecret[:5], c.ClientSecret[len(c.ClientSecret)-5:])
 	} else {
-		fmt.Printf("\tClient Secret: %v\n", c.ClientSecret)
+		fmt.Printf("\tClient Secret: %v\n", strings.Repeat("*", len(c.ClientSecret)))
 	}
 
 	fmt.Printf("\tCallback URL: %v\n", c.CallbackUrl)
+	if c.TlsCertFile != "" {
+		fmt.Printf("\tTLS cert: %v\n", c.TlsCertFile)
+		fmt.Printf("\tTLS key: %v\n", c.TlsKeyFile)
+	}
+	fmt.Printf("\tPKCE: %v\n", c.UsePkce(monzo.Provider))
+	fmt.Printf("\tRefresh ahead: %v\n", c.RefreshAheadDuration())
 }
@@ -0,0 +1,479 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/char8/mzutil/auth"
+	"github.com/char8/mzutil/config"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flags - source and destination store URIs for `store migrate`
+var migrateFrom, migrateTo string
+
+// set by flag - delete values from the source store after migrating
+var migrateWipe bool
+
+func init() {
+	storeMigrateCmd.Flags().StringVar(&migrateFrom, "from", "",
+		"Store URI to copy values from, see --store")
+	storeMigrateCmd.Flags().StringVar(&migrateTo, "to", "",
+		"Store URI to copy values to, see --store")
+	storeMigrateCmd.Flags().BoolVar(&migrateWipe, "wipe", false,
+		"Delete the values from the source store once they are copied and verified")
+	storeMigrateCmd.MarkFlagRequired("from")
+	storeMigrateCmd.MarkFlagRequired("to")
+
+	storeCmd.AddCommand(storeMigrateCmd)
+	rootCmd.AddCommand(storeCmd)
+}
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Manage secret storage",
+	Args:  cobra.NoArgs,
+}
+
+var storeMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy config and tokens between stores",
+	Long: `Copy every stored value, e.g. the auth config and OAuth2 tokens, from one
+store to another and check that each reads back unchanged:
+
+  mzutil store migrate --from file: --to keychain: --wipe`,
+	Args: cobra.NoArgs,
+	RunE: storeMigrateRun,
+}
+
+var ErrMigrateMismatch = errors.New("value read back from destination store does not match")
+var ErrMigrateSameStore = errors.New("--from and --to are the same store")
+
+func storeMigrateRun(cmd *cobra.Command, args []string) error {
+	profile, err := currentProfile()
+	if err != nil {
+		return err
+	}
+
+	from, err := openStore(migrateFrom, profile)
+	if err != nil {
+		return err
+	}
+
+	to, err := openStore(migrateTo, profile)
+	if err != nil {
+		return err
+	}
+
+	// stores describe themselves by backend and location. Copying a store
+	// onto itself would verify every value, then --wipe would delete them.
+	if fmt.Sprint(from) == fmt.Sprint(to) {
+		return ErrMigrateSameStore
+	}
+
+	keys, err := migrateKeys(from)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Copying from %v to %v\n", from, to)
+
+	var copied []string
+	for _, key := range keys {
+		var v json.RawMessage
+		err := from.ReadValue(key, &v)
+		if err == config.ErrNoConfig {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading %v: %v", key, err)
+		}
+
+		err = to.WriteValue(key, v)
+		if err != nil {
+			return fmt.Errorf("writing %v: %v", key, err)
+		}
+
+		err = verifyValue(to, key, v)
+		if err != nil {
+			return fmt.Errorf("verifying %v: %v", key, err)
+		}
+
+		fmt.Printf("\t%v\n", key)
+		copied = append(copied, key)
+	}
+
+	fmt.Printf("Copied %v values\n", len(copied))
+
+	if !migrateWipe {
+		return nil
+	}
+
+	for _, key := range copied {
+		var v json.RawMessage
+		err := from.ReadValue(key, &v)
+		if err != nil {
+			return fmt.Errorf("reading %v: %v", key, err)
+		}
+
+		err = from.DeleteValue(key)
+		if (err != nil) && (err != config.ErrNoConfig) {
+			return fmt.Errorf("deleting %v: %v", key, err)
+		}
+
+		// the stores may overlap, e.g. a file store and one of its dirs, in
+		// which case deleting from one deletes from the other
+		err = verifyValue(to, key, v)
+		if err != nil {
+			if werr := from.WriteValue(key, v); werr != nil {
+				log.WithError(werr).Errorf("could not restore %v", key)
+			}
+			return fmt.Errorf("%w: deleting %v also removed it from %v", ErrMigrateSameStore, key, to)
+		}
+	}
+
+	fmt.Printf("Deleted %v values from %v\n", len(copied), from)
+	return nil
+}
+
+// migrateKeys returns the keys listed by store plus the keys mzutil knows
+// about, as some stores can't list everything they hold. Keys of named
+// profiles sharing the store are left out.
+func migrateKeys(store config.ConfigStore) ([]string, error) {
+	all, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, k := range all {
+		if !strings.Contains(k, "/") {
+			keys = append(keys, k)
+		}
+	}
+
+	for _, k := range []string{monzo.AuthConfigKey, auth.TokenKey(monzo.TokenName)} {
+		found := false
+		for _, have := range keys {
+			found = found || (have == k)
+		}
+		if !found {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+// verifyValue checks that key reads back from store equal to want
+func verifyValue(store config.ConfigStore, key string, want json.RawMessage) error {
+	var got json.RawMessage
+	err := store.ReadValue(key, &got)
+	if err != nil {
+		return err
+	}
+
+	var a, b interface{}
+	if err := json.Unmarshal(want, &a); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(got, &b); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		return ErrMigrateMismatch
+	}
+
+	return nil
+}
+
+// getConfigStore returns the store selected with --store. If --store is given
+// more than once the stores are layered, values are read from the first store
+// holding them and written to the first writable store.
+func getConfigStore() (config.ConfigStore, error) {
+	profile, err := currentProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	return openStores(getStoreSpecs(), profile)
+}
+
+// getStoreSpecs returns the store URIs set with --store, or by the deprecated
+// boolean flags if --store isn't set
+func getStoreSpecs() []string {
+	switch {
+	case rootCmd.PersistentFlags().Changed("store"):
+		return storeSpecs
+	case useEncryptedStore:
+		return []string{"encrypted:"}
+	case useFileStore:
+		return []string{"file:"}
+	default:
+		return storeSpecs
+	}
+}
+
+// openStores opens each of specs for profile, layering them if there is more
+// than one
+func openStores(specs []string, profile string) (config.ConfigStore, error) {
+	stores := make([]config.ConfigStore, 0, len(specs))
+	for _, spec := range specs {
+		s, err := openStore(spec, profile)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+
+	if len(stores) == 1 {
+		return stores[0], nil
+	}
+
+	return config.NewLayeredConfigStore(stores...), nil
+}
+
+// profileStore namespaces the keys of store with the profile name, for
+// stores without a location of their own per profile
+func profileStore(store config.ConfigStore, profile string) config.ConfigStore {
+	if profile == monzo.DefaultProfile {
+		return store
+	}
+	return config.NewPrefixConfigStore(store, profile+"/")
+}
+
+// openStore opens a store from a URI of the form `scheme:[arg]`:
+//
+//	keychain:[service]   the login keychain (default)
+//	file:[path]          plain files, in the XDG config and data dirs by default
+//	encrypted:[path]     passphrase encrypted files, in the XDG data dir by default
+//	pass:[prefix]        the pass(1) password store, under mzutil/ by default
+//	exec:<file.json>     external commands configured in a JSON file
+//	env:[prefix]         read-only values from MZUTIL_* variables
+//	json:<path>          read-only values from a JSON object keyed by store key
+//	stdout:[prefix]      write-only, prints MZUTIL_*=<json> lines to stdout
+//	mem:                 in memory only, nothing is persisted
+//
+// The trailing colon may be left off when there is no argument. Relative
+// paths are relative to the home directory.
+//
+// Values for profiles other than the default are kept apart: the keychain
+// service and pass prefix get the profile name appended, file locations move
+// to a profiles/<name> subdirectory, environment variables are prefixed with
+// MZUTIL_<NAME>_ and exec, json and mem keys with <name>/.
+func openStore(spec, profile string) (config.ConfigStore, error) {
+	scheme, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		scheme, arg = spec[:i], spec[i+1:]
+	}
+
+	named := profile != monzo.DefaultProfile
+
+	switch scheme {
+	case "keychain":
+		if arg == "" {
+			arg = monzo.KeychainServiceName
+		}
+		if named {
+			arg += "-" + profile
+		}
+		return config.NewKeychainConfigStore(arg), nil
+	case "file":
+		if arg != "" {
+			p, err := storePath(arg)
+			if err != nil {
+				return nil, err
+			}
+			if named {
+				p = filepath.Join(p, monzo.ProfilesDir, profile)
+			}
+			return config.NewFileConfigStore(p), nil
+		}
+
+		dirs, err := profileDirs(profile)
+		if err != nil {
+			return nil, err
+		}
+		return config.NewSplitFileConfigStore(dirs.Config, dirs.Data, auth.TokenKeyPrefix), nil
+	case "encrypted":
+		p, err := storePath(arg)
+		if arg == "" {
+			var dirs config.Dirs
+			dirs, err = profileDirs(profile)
+			p = filepath.Join(dirs.Data, monzo.EncryptedStoreDir)
+		} else if named {
+			p = filepath.Join(p, monzo.ProfilesDir, profile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return config.NewEncryptedConfigStore(p, readPassphrase), nil
+	case "pass":
+		if arg == "" {
+			arg = monzo.PassStorePrefix
+		}
+		if named {
+			arg += "/" + profile
+		}
+		return config.NewPassConfigStore(arg), nil
+	case "exec":
+		p, err := storePath(arg)
+		if err != nil {
+			return nil, err
+		}
+		cmds, err := config.LoadExecCommands(p)
+		if err != nil {
+			return nil, err
+		}
+		store, err := config.NewExecConfigStore(arg, cmds)
+		if err != nil {
+			return nil, err
+		}
+		return profileStore(store, profile), nil
+	case "env":
+		if arg == "" {
+			arg = monzo.EnvPrefix
+		}
+		if named {
+			arg += envProfile(profile)
+		}
+		return config.NewEnvConfigStore(arg, monzo.EnvFields), nil
+	case "json":
+		p, err := storePath(arg)
+		if err != nil {
+			return nil, err
+		}
+		return profileStore(config.NewJSONFileConfigStore(p), profile), nil
+	case "stdout":
+		if arg == "" {
+			arg = monzo.EnvPrefix
+		}
+		if named {
+			arg += envProfile(profile)
+		}
+		return config.NewEnvWriterConfigStore(arg, os.Stdout), nil
+	case "mem":
+		return profileStore(config.NewMemConfigStore(), profile), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", spec)
+	}
+}
+
+// storePath resolves a path given in a store URI, a leading ~/ is dropped as
+// relative paths are relative to the home directory anyway
+func storePath(path string) (string, error) {
+	return config.HomePath(strings.TrimPrefix(path, "~/"))
+}
+
+// envProfile returns the part of environment variable names for profile
+func envProfile(profile string) string {
+	return strings.ToUpper(strings.Replace(profile, "-", "_", -1)) + "_"
+}
+
+// baseDirs caches the result of getBaseDirs
+var baseDirs *config.Dirs
+
+// getBaseDirs returns the directories for files, set by --config-dir or
+// $MZUTIL_CONFIG_DIR, otherwise the XDG base directories. The first time the
+// XDG directories are used, files are moved there from the legacy ~/.mzutil
+// and ~/.mzutil-encrypted directories.
+func getBaseDirs() (config.Dirs, error) {
+	if baseDirs != nil {
+		return *baseDirs, nil
+	}
+
+	dir := configDir
+	if dir == "" {
+		dir = os.Getenv(monzo.ConfigDirEnv)
+	}
+
+	if dir != "" {
+		p, err := storePath(dir)
+		if err != nil {
+			return config.Dirs{}, err
+		}
+
+		d := config.SingleDirs(p)
+		baseDirs = &d
+		return d, nil
+	}
+
+	d, err := config.XDGDirs(monzo.AppName)
+	if err != nil {
+		return d, err
+	}
+
+	err = migrateLegacyDirs(d)
+	if err != nil {
+		return d, err
+	}
+
+	baseDirs = &d
+	return d, nil
+}
+
+// getDirs returns the directories for files of the current profile
+func getDirs() (config.Dirs, error) {
+	profile, err := currentProfile()
+	if err != nil {
+		return config.Dirs{}, err
+	}
+
+	return profileDirs(profile)
+}
+
+// profileDirs returns the directories for files of profile, the default
+// profile uses the base directories
+func profileDirs(profile string) (config.Dirs, error) {
+	d, err := getBaseDirs()
+	if (err != nil) || (profile == monzo.DefaultProfile) {
+		return d, err
+	}
+
+	return config.Dirs{
+		Config: filepath.Join(d.Config, monzo.ProfilesDir, profile),
+		Data:   filepath.Join(d.Data, monzo.ProfilesDir, profile),
+		Cache:  filepath.Join(d.Cache, monzo.ProfilesDir, profile),
+	}, nil
+}
+
+// migrateLegacyDirs moves files from the pre-XDG directories into dirs
+func migrateLegacyDirs(d config.Dirs) error {
+	legacy, err := config.HomePath(monzo.LegacyFileStoreDir)
+	if err != nil {
+		return err
+	}
+
+	n, err := config.MigrateLegacyDir(legacy, d, auth.TokenKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("migrating %v: %v", legacy, err)
+	}
+	if n > 0 {
+		log.Infof("moved %v values from %v to %v and %v", n, legacy, d.Config, d.Data)
+	}
+
+	legacy, err = config.HomePath(monzo.LegacyEncryptedDir)
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(d.Data, monzo.EncryptedStoreDir)
+	moved, err := config.MoveLegacyDir(legacy, dest)
+	if err != nil {
+		return fmt.Errorf("migrating %v: %v", legacy, err)
+	}
+	if moved {
+		log.Infof("moved %v to %v", legacy, dest)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/char8/mzutil/config"
+	"github.com/char8/mzutil/daemon"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flag - how far back `sync` fetches transactions
+var syncHistory time.Duration
+
+func init() {
+	syncCmd.Flags().DurationVar(&syncHistory, "history", 31*24*time.Hour,
+		"Fetch transactions from this far back")
+
+	rootCmd.AddCommand(syncCmd)
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Fetch balances, pots and transactions once and save them",
+	Long: `Poll balances, pots and transactions once, like a single run of the daemon,
+and save them as JSON to ` + monzo.SyncSnapshotKey + `.json in the cache dir. This
+suits machines that don't run the daemon, from a timer written by
+install-service. The token is refreshed as needed along the way.`,
+	Args: cobra.NoArgs,
+	RunE: syncRun,
+}
+
+func syncRun(cmd *cobra.Command, args []string) error {
+	client, err := getClient(context.Background())
+	if err != nil {
+		return err
+	}
+
+	s := daemon.NewServer(client, daemon.Options{History: syncHistory})
+	err = s.Poll()
+	if err != nil {
+		return err
+	}
+
+	dirs, err := getDirs()
+	if err != nil {
+		return err
+	}
+
+	// a file store writes the snapshot privately and atomically
+	snap := s.Snapshot()
+	err = config.NewFileConfigStore(dirs.Cache).WriteValue(monzo.SyncSnapshotKey, &snap)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Synced %v accounts to %v\n", len(snap.Accounts),
+		filepath.Join(dirs.Cache, monzo.SyncSnapshotKey+".json"))
+	return nil
+}
@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+
+	"github.com/char8/mzutil/auth"
+	"github.com/char8/mzutil/monzo"
+)
+
+// set by flag - print the access token in `token print`
+var revealToken bool
+
+// set by flag - refresh in `token keepalive` if the token expires this soon
+var keepaliveWithin time.Duration
+
+// set by flag - show a desktop notification if `token keepalive` fails
+var keepaliveNotify bool
+
+func init() {
+	tokenPrintCmd.Flags().BoolVar(&revealToken, "reveal", false,
+		"Confirm that the access token should be written to stdout")
+
+	tokenCmd.AddCommand(tokenStatusCmd)
+	tokenCmd.AddCommand(tokenRefreshCmd)
+	tokenKeepaliveCmd.Flags().DurationVar(&keepaliveWithin, "within", time.Hour,
+		"Refresh the token if it expires within this long")
+	tokenKeepaliveCmd.Flags().BoolVar(&keepaliveNotify, "notify", false,
+		"Show a desktop notification if mzutil login is needed")
+
+	tokenCmd.AddCommand(tokenPrintCmd)
+	tokenCmd.AddCommand(tokenKeepaliveCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Inspect and manage the OAuth2 token",
+	Args:  cobra.NoArgs,
+	RunE:  tokenStatusRun,
+}
+
+var tokenStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show OAuth2 token type and expiry",
+	Args:  cobra.NoArgs,
+	RunE:  tokenStatusRun,
+}
+
+var tokenRefreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Force a refresh of the OAuth2 token",
+	Args:  cobra.NoArgs,
+	RunE:  tokenRefreshRun,
+}
+
+var tokenPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the OAuth2 access token (requires --reveal)",
+	Long: `Print the OAuth2 access token to stdout, e.g. for use with curl:
+
+  curl -H "Authorization: Bearer $(mzutil token print --reveal)" ...`,
+	Args: cobra.NoArgs,
+	RunE: tokenPrintRun,
+}
+
+var tokenKeepaliveCmd = &cobra.Command{
+	Use:   "keepalive",
+	Short: "Refresh the OAuth2 token before it expires, for cron or systemd timers",
+	Long: `Refresh the OAuth2 token if it expires within --within, so that it never
+expires between uses. Run it more often than --within, e.g. from cron:
+
+  */30 * * * * mzutil token keepalive --notify
+
+Exits with status 8 if the token can no longer be refreshed and mzutil login
+is needed, or 6 if not logged in at all.`,
+	Args: cobra.NoArgs,
+	RunE: tokenKeepaliveRun,
+
+	// runs unattended, the exit code and notification say what went wrong
+	SilenceUsage: true,
+}
+
+var ErrRevealRequired = errors.New("refusing to print access token without --reveal")
+
+func tokenStatusRun(cmd *cobra.Command, args []string) error {
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := getAuthenticator(store)
+	if err != nil {
+		return err
+	}
+
+	s, err := a.Status(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Store: %v\n", store)
+	printStatus(s)
+	return nil
+}
+
+func tokenRefreshRun(cmd *cobra.Command, args []string) error {
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := getAuthenticator(store)
+	if err != nil {
+		return err
+	}
+
+	tok, err := a.RefreshToken(context.Background())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Token refreshed")
+	printStatus(auth.StatusOf(tok))
+	return nil
+}
+
+func tokenPrintRun(cmd *cobra.Command, args []string) error {
+	if !revealToken {
+		return ErrRevealRequired
+	}
+
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := getAuthenticator(store)
+	if err != nil {
+		return err
+	}
+
+	ts, err := a.TokenSource(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// refreshes the token first if it has expired
+	tok, err := ts.Token()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(tok.AccessToken)
+	return nil
+}
+
+func tokenKeepaliveRun(cmd *cobra.Command, args []string) error {
+	err := keepalive()
+	if keepaliveNotify && (errors.Is(err, monzo.ErrLoginRequired) || errors.Is(err, monzo.ErrNotLoggedIn)) {
+		nerr := desktopNotify("mzutil login needed", err.Error())
+		if nerr != nil {
+			log.WithError(nerr).Warn("could not show desktop notification")
+		}
+	}
+
+	return err
+}
+
+// keepalive refreshes the token if it expires within keepaliveWithin
+func keepalive() error {
+	store, err := getConfigStore()
+	if err != nil {
+		return err
+	}
+
+	a, err := getAuthenticator(store)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	s, err := a.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	if s.NeedsLogin() {
+		return monzo.ErrLoginRequired
+	}
+
+	if s.Valid && s.Expiry.IsZero() {
+		fmt.Println("Token doesn't expire, not refreshing")
+		return nil
+	}
+
+	if s.Valid && (time.Until(s.Expiry) > keepaliveWithin) {
+		fmt.Printf("Token valid for %v, not refreshing\n", time.Until(s.Expiry).Truncate(time.Second))
+		return nil
+	}
+
+	tok, err := a.RefreshToken(ctx)
+
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) && refreshRejected(rerr) {
+		return fmt.Errorf("%w: %v", monzo.ErrLoginRequired, rerr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if tok.Expiry.IsZero() {
+		fmt.Println("Token refreshed, it doesn't expire")
+		return nil
+	}
+
+	fmt.Printf("Token refreshed, valid for %v\n", time.Until(tok.Expiry).Truncate(time.Second))
+	return nil
+}
+
+// refreshRejected reports whether the server refused the refresh token, as
+// opposed to e.g. being unavailable, so only logging in again will help
+func refreshRejected(rerr *oauth2.RetrieveError) bool {
+	if rerr.ErrorCode == "invalid_grant" {
+		return true
+	}
+
+	if rerr.Response == nil {
+		return false
+	}
+
+	code := rerr.Response.StatusCode
+	return (code == http.StatusBadRequest) || (code == http.StatusUnauthorized)
+}
+
+func printStatus(s auth.TokenStatus) {
+	fmt.Printf("\tType: %v\n", s.Type)
+	fmt.Printf("\tValid: %v\n", s.Valid)
+
+	if s.Expiry.IsZero() {
+		fmt.Println("\tExpiry: never")
+	} else {
+		remaining := time.Until(s.Expiry).Truncate(time.Second)
+		fmt.Printf("\tExpiry: %v\n", s.Expiry.Format(time.RFC822))
+		fmt.Printf("\tRemaining: %v\n", remaining)
+	}
+
+	fmt.Printf("\tRefresh token: %v\n", s.CanRefresh)
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"fmt"
 )
 
 // configuration for the client
@@ -9,7 +10,38 @@ import (
 
 var ErrNoConfig = errors.New("Configuration does not exist")
 
+// ErrReadOnly is returned when writing to a store that can't be written
+var ErrReadOnly = errors.New("Configuration store is read-only")
+
+// CorruptValueError is returned when a stored value can't be decoded, e.g. if
+// a file was truncated
+type CorruptValueError struct {
+	Key      string
+	Location string // where the value is stored, e.g. a file path
+	Err      error
+}
+
+func (e *CorruptValueError) Error() string {
+	return fmt.Sprintf("stored value %v at %v is corrupt (%v), remove it and re-run setup/login",
+		e.Key, e.Location, e.Err)
+}
+
 type ConfigStore interface {
 	ReadValue(key string, v interface{}) error
 	WriteValue(key string, v interface{}) error
+	// DeleteValue removes key, returning ErrNoConfig if it does not exist
+	DeleteValue(key string) error
+	// Keys lists the stored keys in sorted order
+	Keys() ([]string, error)
+}
+
+// ReadOnlyStore is implemented by stores that may not be writable
+type ReadOnlyStore interface {
+	ReadOnly() bool
+}
+
+// IsReadOnly reports whether values can't be written to store
+func IsReadOnly(store ConfigStore) bool {
+	ro, ok := store.(ReadOnlyStore)
+	return ok && ro.ReadOnly()
 }
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters for deriving value keys from the passphrase
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+var ErrBadPassphrase = errors.New("Could not decrypt value, wrong passphrase?")
+var ErrEmptyPassphrase = errors.New("Passphrase must not be empty")
+
+// PassphraseFunc returns the passphrase used to encrypt stored values
+type PassphraseFunc func() ([]byte, error)
+
+// encryptedValue is the on-disk format of a value in an encrypted store
+type encryptedValue struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Stores config values as files like fileConfigStore, but encrypts each value
+// with AES-256-GCM under a key derived from a passphrase with scrypt. New
+// values reuse the salt of the values already in the store, so the slow
+// derivation runs once per store rather than on every write. The key name is
+// used as additional data, so values can't be swapped between keys.
+type encryptedConfigStore struct {
+	files      *fileConfigStore
+	passphrase PassphraseFunc
+
+	mu   sync.Mutex // guards pass, salt and keys
+	pass []byte
+	salt []byte            // for new values, set by unlock
+	keys map[string][]byte // derived keys by salt
+}
+
+var _ ConfigStore = &encryptedConfigStore{}
+
+// NewEncryptedConfigStore returns a ConfigStore in dir which encrypts values
+// at rest. passphrase is called once, on first use.
+func NewEncryptedConfigStore(dir string, passphrase PassphraseFunc) ConfigStore {
+	return &encryptedConfigStore{
+		files:      newFileConfigStore(dir, dir, ""),
+		passphrase: passphrase,
+		keys:       make(map[string][]byte),
+	}
+}
+
+func (c *encryptedConfigStore) String() string {
+	return fmt.Sprintf("EncryptedConfigStore(%v)", c.files.configPath)
+}
+
+func (c *encryptedConfigStore) ReadValue(key string, v interface{}) error {
+	var ev encryptedValue
+	err := c.files.ReadValue(key, &ev)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = c.unlock()
+	if err != nil {
+		return err
+	}
+
+	b, err := c.open(key, ev)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func (c *encryptedConfigStore) WriteValue(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	err = c.unlock()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	ev, err := c.seal(key, b)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return c.files.WriteValue(key, &ev)
+}
+
+func (c *encryptedConfigStore) DeleteValue(key string) error {
+	return c.files.DeleteValue(key)
+}
+
+func (c *encryptedConfigStore) Keys() ([]string, error) {
+	return c.files.Keys()
+}
+
+// unlock fetches the passphrase if we don't have it yet. If the store already
+// holds values the passphrase is checked against one of them, so that values
+// don't end up encrypted under different passphrases. c.mu must be held.
+func (c *encryptedConfigStore) unlock() error {
+	if c.pass != nil {
+		return nil
+	}
+
+	pass, err := c.passphrase()
+	if err != nil {
+		return err
+	}
+
+	if len(pass) == 0 {
+		return ErrEmptyPassphrase
+	}
+
+	c.pass = pass
+
+	keys, err := c.files.Keys()
+	if err != nil {
+		c.pass = nil
+		return err
+	}
+
+	if len(keys) == 0 {
+		c.salt = make([]byte, saltLen)
+		_, err = rand.Read(c.salt)
+		if err != nil {
+			c.pass = nil
+		}
+		return err
+	}
+
+	var ev encryptedValue
+	err = c.files.ReadValue(keys[0], &ev)
+	if err == nil {
+		_, err = c.open(keys[0], ev)
+	}
+
+	if err != nil {
+		// forget the passphrase along with any keys derived from it
+		c.pass = nil
+		c.keys = make(map[string][]byte)
+		return err
+	}
+
+	c.salt = ev.Salt
+	return nil
+}
+
+// aead returns the AEAD for salt, caching the scrypt output as it is
+// deliberately slow. c.mu must be held.
+func (c *encryptedConfigStore) aead(salt []byte) (cipher.AEAD, error) {
+	k, ok := c.keys[string(salt)]
+	if !ok {
+		var err error
+		k, err = scrypt.Key(c.pass, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+		if err != nil {
+			return nil, err
+		}
+		c.keys[string(salt)] = k
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext for key with the store salt and a fresh nonce.
+// c.mu must be held.
+func (c *encryptedConfigStore) seal(key string, plaintext []byte) (encryptedValue, error) {
+	ev := encryptedValue{Version: 1, Salt: c.salt}
+
+	a, err := c.aead(ev.Salt)
+	if err != nil {
+		return ev, err
+	}
+
+	ev.Nonce = make([]byte, a.NonceSize())
+	_, err = rand.Read(ev.Nonce)
+	if err != nil {
+		return ev, err
+	}
+
+	ev.Data = a.Seal(nil, ev.Nonce, plaintext, []byte(key))
+	return ev, nil
+}
+
+// open decrypts a value sealed for key. c.mu must be held.
+func (c *encryptedConfigStore) open(key string, ev encryptedValue) ([]byte, error) {
+	if ev.Version != 1 {
+		return nil, &CorruptValueError{
+			Key:      key,
+			Location: c.String(),
+			Err:      fmt.Errorf("unknown version %v", ev.Version),
+		}
+	}
+
+	a, err := c.aead(ev.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ev.Nonce) != a.NonceSize() {
+		return nil, &CorruptValueError{
+			Key:      key,
+			Location: c.String(),
+			Err:      errors.New("bad nonce length"),
+		}
+	}
+
+	b, err := a.Open(nil, ev.Nonce, ev.Data, []byte(key))
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	return b, nil
+}
@@ -0,0 +1,195 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+type testValue struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// storeDir returns a dir for a file store, which creates it with the right
+// permissions on the first write
+func storeDir(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "store")
+}
+
+func passphrase(p string) PassphraseFunc {
+	return func() ([]byte, error) {
+		return []byte(p), nil
+	}
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	dir := storeDir(t)
+	s := NewEncryptedConfigStore(dir, passphrase("secret"))
+
+	want := testValue{Name: "token", Count: 3}
+	err := s.WriteValue("key", &want)
+	if err != nil {
+		t.Fatalf("WriteValue: %v", err)
+	}
+
+	// a new store has to derive the key again from the passphrase
+	var got testValue
+	err = NewEncryptedConfigStore(dir, passphrase("secret")).ReadValue("key", &got)
+	if err != nil {
+		t.Fatalf("ReadValue: %v", err)
+	}
+
+	if got != want {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+}
+
+func TestEncryptedStoreNotPlaintext(t *testing.T) {
+	dir := storeDir(t)
+	s := NewEncryptedConfigStore(dir, passphrase("secret"))
+
+	err := s.WriteValue("key", &testValue{Name: "plaintext-marker"})
+	if err != nil {
+		t.Fatalf("WriteValue: %v", err)
+	}
+
+	var ev encryptedValue
+	err = NewFileConfigStore(dir).ReadValue("key", &ev)
+	if err != nil {
+		t.Fatalf("reading the raw value: %v", err)
+	}
+
+	if bytes.Contains(ev.Data, []byte("plaintext-marker")) {
+		t.Error("value is stored in plaintext")
+	}
+}
+
+func TestEncryptedStoreWrongPassphrase(t *testing.T) {
+	dir := storeDir(t)
+
+	err := NewEncryptedConfigStore(dir, passphrase("secret")).WriteValue("key", &testValue{Name: "a"})
+	if err != nil {
+		t.Fatalf("WriteValue: %v", err)
+	}
+
+	wrong := NewEncryptedConfigStore(dir, passphrase("wrong"))
+
+	var got testValue
+	err = wrong.ReadValue("key", &got)
+	if err != ErrBadPassphrase {
+		t.Errorf("ReadValue with the wrong passphrase returned %v, want ErrBadPassphrase", err)
+	}
+
+	// writing must not mix values under different passphrases
+	err = wrong.WriteValue("other", &testValue{Name: "b"})
+	if err != ErrBadPassphrase {
+		t.Errorf("WriteValue with the wrong passphrase returned %v, want ErrBadPassphrase", err)
+	}
+}
+
+func TestEncryptedStoreEmptyPassphrase(t *testing.T) {
+	s := NewEncryptedConfigStore(storeDir(t), passphrase(""))
+
+	err := s.WriteValue("key", &testValue{})
+	if err != ErrEmptyPassphrase {
+		t.Errorf("WriteValue returned %v, want ErrEmptyPassphrase", err)
+	}
+}
+
+func TestEncryptedStorePassphraseError(t *testing.T) {
+	perr := errors.New("no tty")
+	calls := 0
+	s := NewEncryptedConfigStore(storeDir(t), func() ([]byte, error) {
+		calls++
+		return nil, perr
+	})
+
+	for i := 0; i < 2; i++ {
+		err := s.WriteValue("key", &testValue{})
+		if err != perr {
+			t.Errorf("WriteValue returned %v, want %v", err, perr)
+		}
+	}
+
+	// a failed passphrase isn't remembered, so it is asked for again
+	if calls != 2 {
+		t.Errorf("passphrase asked for %v times, want 2", calls)
+	}
+}
+
+func TestEncryptedStoreReusesSalt(t *testing.T) {
+	dir := storeDir(t)
+	s := NewEncryptedConfigStore(dir, passphrase("secret"))
+
+	for _, k := range []string{"a", "b"} {
+		err := s.WriteValue(k, &testValue{Name: k})
+		if err != nil {
+			t.Fatalf("WriteValue(%v): %v", k, err)
+		}
+	}
+
+	// a later process picks up the salt of the existing values
+	err := NewEncryptedConfigStore(dir, passphrase("secret")).WriteValue("c", &testValue{Name: "c"})
+	if err != nil {
+		t.Fatalf("WriteValue(c): %v", err)
+	}
+
+	files := NewFileConfigStore(dir)
+
+	var salt []byte
+	for _, k := range []string{"a", "b", "c"} {
+		var ev encryptedValue
+		err := files.ReadValue(k, &ev)
+		if err != nil {
+			t.Fatalf("reading the raw value of %v: %v", k, err)
+		}
+
+		if len(ev.Salt) != saltLen {
+			t.Errorf("salt of %v has length %v, want %v", k, len(ev.Salt), saltLen)
+		}
+
+		if salt == nil {
+			salt = ev.Salt
+		} else if !bytes.Equal(ev.Salt, salt) {
+			t.Errorf("salt of %v differs from the first value", k)
+		}
+	}
+
+	// each value still gets its own nonce
+	var a, b encryptedValue
+	files.ReadValue("a", &a)
+	files.ReadValue("b", &b)
+	if bytes.Equal(a.Nonce, b.Nonce) {
+		t.Error("values share a nonce")
+	}
+}
+
+func TestEncryptedStoreKeyBoundToName(t *testing.T) {
+	dir := storeDir(t)
+	s := NewEncryptedConfigStore(dir, passphrase("secret"))
+
+	err := s.WriteValue("a", &testValue{Name: "a"})
+	if err != nil {
+		t.Fatalf("WriteValue: %v", err)
+	}
+
+	// move the value of a to b, it must not decrypt under the other key
+	files := NewFileConfigStore(dir)
+
+	var ev encryptedValue
+	err = files.ReadValue("a", &ev)
+	if err == nil {
+		err = files.WriteValue("b", &ev)
+	}
+	if err != nil {
+		t.Fatalf("copying the raw value: %v", err)
+	}
+
+	var got testValue
+	err = s.ReadValue("b", &got)
+	if err != ErrBadPassphrase {
+		t.Errorf("ReadValue of a swapped value returned %v, want ErrBadPassphrase", err)
+	}
+}
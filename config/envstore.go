@@ -0,0 +1,160 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// EnvFields maps store keys to the JSON fields of their value and the
+// variables (less the prefix) that can set each field, e.g.
+//
+//	{"auth-config": {"client_id": "CLIENT_ID"}}
+//
+// lets MZUTIL_CLIENT_ID set the client_id of the auth-config value.
+type EnvFields map[string]map[string]string
+
+// Reads config values from environment variables. A value is read as JSON
+// from a variable named after the key with a prefix, e.g. `auth-config` is
+// read from MZUTIL_AUTH_CONFIG. If that isn't set the value is built from the
+// variables for its fields in EnvFields. The environment can't be written so
+// the store is read-only.
+type envConfigStore struct {
+	prefix string
+	fields EnvFields
+}
+
+var _ ConfigStore = &envConfigStore{}
+var _ ReadOnlyStore = &envConfigStore{}
+
+// NewEnvConfigStore returns a read-only ConfigStore reading variables
+// starting with prefix. fields may be nil.
+func NewEnvConfigStore(prefix string, fields EnvFields) ConfigStore {
+	return &envConfigStore{prefix: prefix, fields: fields}
+}
+
+func (c *envConfigStore) String() string {
+	return fmt.Sprintf("EnvConfigStore(%v*)", c.prefix)
+}
+
+func (c *envConfigStore) ReadOnly() bool {
+	return true
+}
+
+func (c *envConfigStore) ReadValue(key string, v interface{}) error {
+	name := envName(c.prefix, key)
+
+	s, ok := os.LookupEnv(name)
+	if !ok || (s == "") {
+		return c.readFields(key, v)
+	}
+
+	err := json.Unmarshal([]byte(s), v)
+	if err != nil {
+		return &CorruptValueError{Key: key, Location: "$" + name, Err: err}
+	}
+
+	return nil
+}
+
+// readFields builds the value for key from the variables for its fields
+func (c *envConfigStore) readFields(key string, v interface{}) error {
+	obj := make(map[string]string)
+	for field, suffix := range c.fields[key] {
+		if s := os.Getenv(c.prefix + suffix); s != "" {
+			obj[field] = s
+		}
+	}
+
+	if len(obj) == 0 {
+		return ErrNoConfig
+	}
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func (c *envConfigStore) WriteValue(key string, v interface{}) error {
+	return ErrReadOnly
+}
+
+func (c *envConfigStore) DeleteValue(key string) error {
+	return ErrReadOnly
+}
+
+// Keys returns the keys in EnvFields that are set. Variables without an
+// EnvFields entry can't be mapped back to keys so aren't listed.
+func (c *envConfigStore) Keys() ([]string, error) {
+	var keys []string
+	for key := range c.fields {
+		var v interface{}
+		if c.ReadValue(key, &v) == nil {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Writes values as `NAME=<json>` lines named like the variables read by
+// envConfigStore, e.g. to stdout so that a CI system can capture refreshed
+// tokens. Nothing can be read back, so this is normally layered over an env
+// or read-only store.
+type envWriterConfigStore struct {
+	prefix string
+	w      io.Writer
+}
+
+var _ ConfigStore = &envWriterConfigStore{}
+
+// NewEnvWriterConfigStore returns a write-only ConfigStore writing variable
+// assignments with prefix to w
+func NewEnvWriterConfigStore(prefix string, w io.Writer) ConfigStore {
+	return &envWriterConfigStore{prefix: prefix, w: w}
+}
+
+func (c *envWriterConfigStore) String() string {
+	return fmt.Sprintf("EnvWriterConfigStore(%v*)", c.prefix)
+}
+
+func (c *envWriterConfigStore) ReadValue(key string, v interface{}) error {
+	return ErrNoConfig
+}
+
+func (c *envWriterConfigStore) WriteValue(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(c.w, "%v=%s\n", envName(c.prefix, key), b)
+	return err
+}
+
+func (c *envWriterConfigStore) DeleteValue(key string) error {
+	return ErrNoConfig
+}
+
+func (c *envWriterConfigStore) Keys() ([]string, error) {
+	return nil, nil
+}
+
+// envName returns the name of the environment variable holding key, which is
+// upper cased with anything but letters and digits replaced by _
+func envName(prefix, key string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		if (r < unicode.MaxASCII) && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var ErrNoCommand = errors.New("No command configured for this operation")
+
+// ExecCommands configures an exec ConfigStore. Each command is a
+// text/template run with `sh -c`, {{.Key}} expands to the shell quoted key.
+//
+//	Read   prints the value for the key on stdout
+//	Write  reads the value for the key from stdin
+//	Delete removes the key
+//	List   prints every stored key on its own line (optional)
+//	Exists exits zero if the key exists (optional, Read is used instead)
+//
+// Values are passed as JSON. A read that exits with NotFoundStatus (if
+// non-zero), or prints nothing, means the key does not exist.
+type ExecCommands struct {
+	Read           string `json:"read"`
+	Write          string `json:"write"`
+	Delete         string `json:"delete"`
+	List           string `json:"list"`
+	Exists         string `json:"exists"`
+	NotFoundStatus int    `json:"not_found_status"`
+}
+
+// Stores config values in an external secrets manager by running commands,
+// e.g. pass or secret-tool
+type execConfigStore struct {
+	name string
+	cmds ExecCommands
+
+	read, write, del, list, exists *template.Template
+
+	mu sync.RWMutex
+}
+
+var _ ConfigStore = &execConfigStore{}
+
+// NewExecConfigStore returns a ConfigStore that runs cmds to read and write
+// values. name is used to describe the store.
+func NewExecConfigStore(name string, cmds ExecCommands) (ConfigStore, error) {
+	c := &execConfigStore{name: name, cmds: cmds}
+
+	var err error
+	for _, t := range []struct {
+		tmpl **template.Template
+		cmd  string
+	}{
+		{&c.read, cmds.Read},
+		{&c.write, cmds.Write},
+		{&c.del, cmds.Delete},
+		{&c.list, cmds.List},
+		{&c.exists, cmds.Exists},
+	} {
+		if t.cmd == "" {
+			continue
+		}
+
+		*t.tmpl, err = template.New(name).Option("missingkey=error").Parse(t.cmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// LoadExecCommands reads ExecCommands from a JSON file
+func LoadExecCommands(path string) (ExecCommands, error) {
+	var cmds ExecCommands
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cmds, err
+	}
+
+	err = json.Unmarshal(b, &cmds)
+	return cmds, err
+}
+
+// passCommands runs the pass(1) password manager, storing values under
+// prefix in the password store
+func passCommands(prefix string) ExecCommands {
+	dir := shellQuote(prefix)
+	store := `"${PASSWORD_STORE_DIR:-$HOME/.password-store}"/` + dir
+	return ExecCommands{
+		Read:   "pass show " + dir + "/{{.Key}}",
+		Write:  "pass insert --multiline --force " + dir + "/{{.Key}} >/dev/null",
+		Delete: "pass rm --force " + dir + "/{{.Key}} >/dev/null",
+		// nothing has been stored yet if the prefix dir doesn't exist. Named
+		// profiles are in subdirs of the default prefix, so don't recurse.
+		List: "[ -d " + store + " ] || exit 0; cd " + store +
+			` && find . -maxdepth 1 -type f -name '*.gpg' | sed -e 's|^\./||' -e 's|\.gpg$||'`,
+		// checks for the file rather than running gpg to decrypt it
+		Exists:         "test -f " + store + "/{{.Key}}.gpg",
+		NotFoundStatus: 1,
+	}
+}
+
+// NewPassConfigStore returns a ConfigStore that keeps values in the pass(1)
+// password store under prefix
+func NewPassConfigStore(prefix string) ConfigStore {
+	c, err := NewExecConfigStore("pass:"+prefix, passCommands(prefix))
+	if err != nil {
+		// the templates are constant so this is a programming error
+		panic(err)
+	}
+	return c
+}
+
+func (c *execConfigStore) String() string {
+	return fmt.Sprintf("ExecConfigStore(%v)", c.name)
+}
+
+func (c *execConfigStore) ReadValue(key string, v interface{}) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out, err := c.run(c.read, key, nil)
+
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && (c.cmds.NotFoundStatus != 0) &&
+		(ee.ExitCode() == c.cmds.NotFoundStatus) {
+		return ErrNoConfig
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(bytes.TrimSpace(out)) == 0 {
+		return ErrNoConfig
+	}
+
+	err = json.Unmarshal(out, v)
+	if err != nil {
+		return &CorruptValueError{Key: key, Location: c.String(), Err: err}
+	}
+
+	return nil
+}
+
+func (c *execConfigStore) WriteValue(key string, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.run(c.write, key, b)
+	return err
+}
+
+func (c *execConfigStore) DeleteValue(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// deleting a missing key should return ErrNoConfig, most tools don't
+	// distinguish that in their exit status so check first
+	var ee *exec.ExitError
+	if c.exists != nil {
+		_, err := c.run(c.exists, key, nil)
+		if errors.As(err, &ee) {
+			return ErrNoConfig
+		}
+	} else if c.read != nil {
+		_, err := c.run(c.read, key, nil)
+		if errors.As(err, &ee) && (c.cmds.NotFoundStatus != 0) &&
+			(ee.ExitCode() == c.cmds.NotFoundStatus) {
+			return ErrNoConfig
+		}
+	}
+
+	_, err := c.run(c.del, key, nil)
+	return err
+}
+
+func (c *execConfigStore) Keys() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out, err := c.run(c.list, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if k := strings.TrimSpace(sc.Text()); k != "" {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, sc.Err()
+}
+
+// run expands the command template t for key and runs it with stdin as its
+// input, returning its output. Stderr is passed through so that tools can
+// report errors or prompt via pinentry.
+func (c *execConfigStore) run(t *template.Template, key string, stdin []byte) ([]byte, error) {
+	if t == nil {
+		return nil, ErrNoCommand
+	}
+
+	var sb strings.Builder
+	err := t.Execute(&sb, struct{ Key string }{shellQuote(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("sh", "-c", sb.String())
+	cmd.Stderr = os.Stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	return cmd.Output()
+}
+
+// shellQuote quotes s for use as a single word in a sh command line
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
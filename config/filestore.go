@@ -5,10 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -19,28 +19,79 @@ const (
 
 var ErrInvalidPerms = errors.New("FileConfig dir/files have bad permissions (not 0700/0600)")
 
-// Stores config values in a private directory under $HOME
-// in the filename <key>.json
+// InvalidPermsError names a file or dir in a file store with bad permissions.
+// It matches ErrInvalidPerms with errors.Is.
+type InvalidPermsError struct {
+	Path string
+	Perm os.FileMode
+	Want os.FileMode
+}
+
+func (e *InvalidPermsError) Error() string {
+	return fmt.Sprintf("%v has permissions %#o, should be %#o", e.Path, e.Perm, e.Want)
+}
+
+func (e *InvalidPermsError) Is(target error) bool {
+	return target == ErrInvalidPerms
+}
+
+// Stores config values in private directories in the filename <key>.json.
+// Values with keys starting with dataPrefix, e.g. tokens, can be kept in a
+// separate directory from the rest, e.g. settings.
 // should NOT use user-specified values as key!
 type fileConfigStore struct {
-	configDirName string
-	dirPerms      os.FileMode
-	filePerms     os.FileMode
-	mu            sync.RWMutex
+	configPath string // directory for values
+	dataPath   string // directory for values with dataPrefix
+	dataPrefix string
+	dirPerms   os.FileMode
+	filePerms  os.FileMode
+	mu         sync.RWMutex
 }
 
 var _ ConfigStore = &fileConfigStore{}
 
-func NewFileConfigStore(configDir string) ConfigStore {
+// NewFileConfigStore returns a store keeping all values in dir
+func NewFileConfigStore(dir string) ConfigStore {
+	return newFileConfigStore(dir, dir, "")
+}
+
+// NewSplitFileConfigStore returns a store keeping values with keys starting
+// with dataPrefix in dataDir and the rest in configDir
+func NewSplitFileConfigStore(configDir, dataDir, dataPrefix string) ConfigStore {
+	return newFileConfigStore(configDir, dataDir, dataPrefix)
+}
+
+func newFileConfigStore(configDir, dataDir, dataPrefix string) *fileConfigStore {
 	return &fileConfigStore{
-		configDirName: configDir,
-		dirPerms:      DirPerms,
-		filePerms:     FilePerms,
+		configPath: configDir,
+		dataPath:   dataDir,
+		dataPrefix: dataPrefix,
+		dirPerms:   DirPerms,
+		filePerms:  FilePerms,
 	}
 }
 
 func (c *fileConfigStore) String() string {
-	return fmt.Sprintf("FileConfigStore(%v)", c.getConfigPath())
+	if c.dataPath == c.configPath {
+		return fmt.Sprintf("FileConfigStore(%v)", c.configPath)
+	}
+	return fmt.Sprintf("FileConfigStore(%v, %v)", c.configPath, c.dataPath)
+}
+
+// dirFor returns the directory holding key
+func (c *fileConfigStore) dirFor(key string) string {
+	if (c.dataPrefix != "") && strings.HasPrefix(key, c.dataPrefix) {
+		return c.dataPath
+	}
+	return c.configPath
+}
+
+// dirs returns the distinct directories of the store
+func (c *fileConfigStore) dirs() []string {
+	if c.dataPath == c.configPath {
+		return []string{c.configPath}
+	}
+	return []string{c.configPath, c.dataPath}
 }
 
 // Json unmarshals the contents of a config file into the value
@@ -49,80 +100,170 @@ func (c *fileConfigStore) ReadValue(key string, v interface{}) error {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	err := c.verifyConfigDir()
+	dir := c.dirFor(key)
+	err := c.verifyConfigDir(dir)
 	if err != nil {
 		return err
 	}
 
 	// Config files are pretty small so use ioutil.ReadFile()
-	fp := filepath.Join(c.getConfigPath(), key+".json")
+	fp := filepath.Join(dir, key+".json")
 	b, err := ioutil.ReadFile(fp)
 
+	if os.IsNotExist(err) {
+		return ErrNoConfig
+	}
+
 	if err != nil {
 		return err
 	}
 
 	err = json.Unmarshal(b, v)
 	if err != nil {
-		return err
+		return &CorruptValueError{Key: key, Location: fp, Err: err}
 	}
 
 	return nil
 }
 
 // Writes a struct value pointed to by v to the named
-// config file in the config directory. If the file doesn't
-// exist it will be created with 0600 permissions
-func (c fileConfigStore) WriteValue(key string, v interface{}) error {
+// config file in the config directory. The value is written to a 0600
+// temporary file which is synced and renamed over the config file, so a
+// crash leaves either the old or the new value in place.
+func (c *fileConfigStore) WriteValue(key string, v interface{}) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	err := c.verifyConfigDir()
+	dir := c.dirFor(key)
+	err := c.verifyConfigDir(dir)
 
 	// create the dir if it doesn't exist
 	if err == ErrNoConfig {
-		err = os.Mkdir(c.getConfigPath(), c.dirPerms)
+		err = os.MkdirAll(dir, c.dirPerms)
 	}
 
 	if err != nil {
 		return err
 	}
 
-	fp := filepath.Join(c.getConfigPath(), key+".json")
-	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE, c.filePerms)
+	b, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	// TempFile creates files with 0600 permissions
+	f, err := ioutil.TempFile(dir, key+".json.tmp")
+	if err != nil {
+		return err
+	}
 
-	b, err := json.Marshal(v)
+	tmp := f.Name()
+
+	err = writeAndSync(f, b)
+	if err == nil {
+		err = os.Chmod(tmp, c.filePerms)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, key+".json"))
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
 
-	_, err = f.Write(b)
+	return syncDir(dir)
+}
+
+// writeAndSync writes b to f, flushes it to disk and closes f
+func writeAndSync(f *os.File, b []byte) error {
+	_, err := f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
 
-	return err
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
 }
 
-// Get the config dir as $HOMEDIR/<CONFIG_DIRNAME>/
-func (c *fileConfigStore) getConfigPath() string {
-	u, err := user.Current()
+// syncDir flushes the directory entries of dir to disk, so that renames
+// survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	return d.Sync()
+}
 
+// Removes the config file for key from the config directory
+func (c *fileConfigStore) DeleteValue(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := c.dirFor(key)
+	err := c.verifyConfigDir(dir)
+	if err != nil {
+		return err
+	}
+
+	fp := filepath.Join(dir, key+".json")
+	err = os.Remove(fp)
+	if os.IsNotExist(err) {
+		return ErrNoConfig
+	}
 	if err != nil {
-		// TODO: return error instead
-		log.Fatalf("Could not get current user: %v", err)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// Lists the keys of all the config files in the config directories
+func (c *fileConfigStore) Keys() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var keys []string
+	for _, dir := range c.dirs() {
+		err := c.verifyConfigDir(dir)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fs, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range fs {
+			name := f.Name()
+			if f.IsDir() || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+
+			// only list files that are where this store would look for them
+			key := strings.TrimSuffix(name, ".json")
+			if c.dirFor(key) == dir {
+				keys = append(keys, key)
+			}
+		}
 	}
 
-	p := filepath.Join(u.HomeDir, c.configDirName)
-	return p
+	sort.Strings(keys)
+	return keys, nil
 }
 
 // Checks that the config dir/files are private to the user
 // 0700/0600 permissions. Otherwise fail.
-func (c *fileConfigStore) verifyConfigDir() error {
-	path := c.getConfigPath()
+func (c *fileConfigStore) verifyConfigDir(path string) error {
 	stat, err := os.Stat(path)
 	if err != nil || !stat.IsDir() {
 		if os.IsNotExist(err) {
@@ -131,22 +272,57 @@ func (c *fileConfigStore) verifyConfigDir() error {
 		return err
 	}
 
+	bad, err := checkPerms(path, c.dirPerms, c.filePerms)
+	if err != nil {
+		return err
+	}
+
+	if len(bad) > 0 {
+		return bad[0]
+	}
+
+	return nil
+}
+
+// CheckPerms returns every problem with the permissions of a file store
+// directory, which must be 0700 with all value files in it 0600. Other files,
+// e.g. templates kept alongside the config, are left alone.
+func CheckPerms(dir string) ([]*InvalidPermsError, error) {
+	return checkPerms(dir, DirPerms, FilePerms)
+}
+
+func checkPerms(dir string, dirPerms, filePerms os.FileMode) ([]*InvalidPermsError, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var bad []*InvalidPermsError
+
 	// check that config dir has 0700 permissions
-	if stat.Mode().Perm() != c.dirPerms {
-		return ErrInvalidPerms
+	if stat.Mode().Perm() != dirPerms {
+		bad = append(bad, &InvalidPermsError{Path: dir, Perm: stat.Mode().Perm(), Want: dirPerms})
 	}
 
-	// check that all contents have 0600 permissions
-	fs, err := ioutil.ReadDir(path)
+	// check that all values have 0600 permissions
+	fs, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, f := range fs {
-		if !f.IsDir() && (f.Mode().Perm() != c.filePerms) {
-			return ErrInvalidPerms
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		if f.Mode().Perm() != filePerms {
+			bad = append(bad, &InvalidPermsError{
+				Path: filepath.Join(dir, f.Name()),
+				Perm: f.Mode().Perm(),
+				Want: filePerms,
+			})
 		}
 	}
 
-	return nil
+	return bad, nil
 }
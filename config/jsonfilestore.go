@@ -0,0 +1,92 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// Reads config values from a single JSON object keyed by store key, e.g. a
+// secret mounted read-only into a container:
+//
+//	{"auth-config": {...}, "oauth_token:monzo": {...}}
+//
+// The file is re-read on every access and is never written.
+type jsonFileConfigStore struct {
+	path string
+}
+
+var _ ConfigStore = &jsonFileConfigStore{}
+var _ ReadOnlyStore = &jsonFileConfigStore{}
+
+// NewJSONFileConfigStore returns a read-only ConfigStore for the JSON file at
+// path
+func NewJSONFileConfigStore(path string) ConfigStore {
+	return &jsonFileConfigStore{path: path}
+}
+
+func (c *jsonFileConfigStore) String() string {
+	return fmt.Sprintf("JSONFileConfigStore(%v)", c.path)
+}
+
+func (c *jsonFileConfigStore) ReadOnly() bool {
+	return true
+}
+
+func (c *jsonFileConfigStore) load() (map[string]json.RawMessage, error) {
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]json.RawMessage
+	err = json.Unmarshal(b, &values)
+	if err != nil {
+		return nil, &CorruptValueError{Key: "*", Location: c.path, Err: err}
+	}
+
+	return values, nil
+}
+
+func (c *jsonFileConfigStore) ReadValue(key string, v interface{}) error {
+	values, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	b, ok := values[key]
+	if !ok {
+		return ErrNoConfig
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return &CorruptValueError{Key: key, Location: c.path, Err: err}
+	}
+
+	return nil
+}
+
+func (c *jsonFileConfigStore) WriteValue(key string, v interface{}) error {
+	return ErrReadOnly
+}
+
+func (c *jsonFileConfigStore) DeleteValue(key string) error {
+	return ErrReadOnly
+}
+
+func (c *jsonFileConfigStore) Keys() ([]string, error) {
+	values, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
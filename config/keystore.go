@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 
 	"encoding/base64"
@@ -10,6 +11,10 @@ import (
 	"github.com/zalando/go-keyring"
 )
 
+// keychainIndexKey holds the list of keys written to the keychain, as the
+// keyring API has no way of enumerating the secrets for a service
+const keychainIndexKey = "mzutil:index"
+
 type keychainConfigStore struct {
 	serviceName string
 	mu          sync.RWMutex
@@ -22,7 +27,7 @@ func NewKeychainConfigStore(serviceName string) ConfigStore {
 var _ ConfigStore = &keychainConfigStore{}
 
 func (c *keychainConfigStore) String() string {
-	return fmt.Sprintf("KeychainConfigStore(local)")
+	return fmt.Sprintf("KeychainConfigStore(%v)", c.serviceName)
 }
 
 // Store a value v as a b64 encoded json string in the local keychain
@@ -31,25 +36,63 @@ func (c *keychainConfigStore) WriteValue(key string, v interface{}) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	b, err := json.Marshal(v)
+	err := c.set(key, v)
 	if err != nil {
 		return err
 	}
 
-	s := base64.StdEncoding.EncodeToString(b)
-	if err != nil {
+	return c.updateIndex(key, true)
+}
+
+func (c *keychainConfigStore) ReadValue(key string, v interface{}) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.get(key, v)
+}
+
+func (c *keychainConfigStore) DeleteValue(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := keyring.Delete(c.serviceName, key)
+	if err == keyring.ErrNotFound {
+		err = ErrNoConfig
+	} else if err != nil {
 		return err
 	}
 
-	err = keyring.Set(c.serviceName, key, s)
+	// drop the key from the index even if the secret was removed elsewhere
+	ierr := c.updateIndex(key, false)
+	if ierr != nil {
+		return ierr
+	}
 
 	return err
 }
 
-func (c *keychainConfigStore) ReadValue(key string, v interface{}) error {
+// Keys returns the keys recorded in the index. Values written before the
+// index existed are not listed until they are written again.
+func (c *keychainConfigStore) Keys() ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	return c.readIndex()
+}
+
+// set writes v as a b64 encoded json string, c.mu must be held
+func (c *keychainConfigStore) set(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s := base64.StdEncoding.EncodeToString(b)
+	return keyring.Set(c.serviceName, key, s)
+}
+
+// get reads a value written by set into v, c.mu must be held
+func (c *keychainConfigStore) get(key string, v interface{}) error {
 	s, err := keyring.Get(c.serviceName, key)
 
 	if err != nil {
@@ -68,3 +111,40 @@ func (c *keychainConfigStore) ReadValue(key string, v interface{}) error {
 	err = json.Unmarshal(b, v)
 	return err
 }
+
+// readIndex returns the sorted list of stored keys, c.mu must be held
+func (c *keychainConfigStore) readIndex() ([]string, error) {
+	var keys []string
+
+	err := c.get(keychainIndexKey, &keys)
+	if err == ErrNoConfig {
+		return nil, nil
+	}
+
+	return keys, err
+}
+
+// updateIndex adds or removes key from the index, c.mu must be held for
+// writing
+func (c *keychainConfigStore) updateIndex(key string, present bool) error {
+	keys, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchStrings(keys, key)
+	found := (i < len(keys)) && (keys[i] == key)
+
+	switch {
+	case present && !found:
+		keys = append(keys, "")
+		copy(keys[i+1:], keys[i:])
+		keys[i] = key
+	case !present && found:
+		keys = append(keys[:i], keys[i+1:]...)
+	default:
+		return nil
+	}
+
+	return c.set(keychainIndexKey, keys)
+}
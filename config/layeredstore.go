@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Combines an ordered list of stores. Values are read from the first store
+// holding the key and written to the first store that isn't read-only, so
+// that e.g. settings can be read from a file while tokens are kept in the
+// keychain.
+type layeredConfigStore struct {
+	stores []ConfigStore
+}
+
+var _ ConfigStore = &layeredConfigStore{}
+
+// NewLayeredConfigStore returns a ConfigStore layering stores, in order of
+// precedence
+func NewLayeredConfigStore(stores ...ConfigStore) ConfigStore {
+	return &layeredConfigStore{stores: stores}
+}
+
+func (c *layeredConfigStore) String() string {
+	names := make([]string, len(c.stores))
+	for i, s := range c.stores {
+		names[i] = fmt.Sprint(s)
+	}
+	return fmt.Sprintf("LayeredConfigStore(%v)", strings.Join(names, ", "))
+}
+
+func (c *layeredConfigStore) ReadValue(key string, v interface{}) error {
+	for _, s := range c.stores {
+		err := s.ReadValue(key, v)
+		if err != ErrNoConfig {
+			return err
+		}
+	}
+
+	return ErrNoConfig
+}
+
+func (c *layeredConfigStore) WriteValue(key string, v interface{}) error {
+	for _, s := range c.stores {
+		if !IsReadOnly(s) {
+			return s.WriteValue(key, v)
+		}
+	}
+
+	return ErrReadOnly
+}
+
+// DeleteValue removes key from every writable store, so that a value in a
+// lower layer isn't uncovered by the delete
+func (c *layeredConfigStore) DeleteValue(key string) error {
+	result := ErrNoConfig
+
+	for _, s := range c.stores {
+		if IsReadOnly(s) {
+			continue
+		}
+
+		err := s.DeleteValue(key)
+		switch {
+		case err == ErrNoConfig:
+		case err != nil:
+			return err
+		default:
+			result = nil
+		}
+	}
+
+	return result
+}
+
+// Keys returns the union of the keys in all stores
+func (c *layeredConfigStore) Keys() ([]string, error) {
+	seen := make(map[string]bool)
+	var keys []string
+
+	for _, s := range c.stores {
+		ks, err := s.Keys()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range ks {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
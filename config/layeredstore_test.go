@@ -0,0 +1,140 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+// readOnlyStore wraps a store as a read-only layer, like the env: store
+type readOnlyStore struct {
+	ConfigStore
+}
+
+func (readOnlyStore) ReadOnly() bool {
+	return true
+}
+
+func mustWrite(t *testing.T, s ConfigStore, key, name string) {
+	t.Helper()
+
+	err := s.WriteValue(key, &testValue{Name: name})
+	if err != nil {
+		t.Fatalf("WriteValue(%v): %v", key, err)
+	}
+}
+
+func readName(s ConfigStore, key string) (string, error) {
+	var v testValue
+	err := s.ReadValue(key, &v)
+	return v.Name, err
+}
+
+func TestLayeredStoreReadOrder(t *testing.T) {
+	top, bottom := NewMemConfigStore(), NewMemConfigStore()
+	s := NewLayeredConfigStore(top, bottom)
+
+	mustWrite(t, top, "both", "top")
+	mustWrite(t, bottom, "both", "bottom")
+	mustWrite(t, bottom, "bottom-only", "bottom")
+
+	for key, want := range map[string]string{"both": "top", "bottom-only": "bottom"} {
+		got, err := readName(s, key)
+		if err != nil {
+			t.Errorf("ReadValue(%v): %v", key, err)
+		} else if got != want {
+			t.Errorf("ReadValue(%v) read from %v, want %v", key, got, want)
+		}
+	}
+
+	_, err := readName(s, "missing")
+	if err != ErrNoConfig {
+		t.Errorf("ReadValue of a missing key returned %v, want ErrNoConfig", err)
+	}
+}
+
+func TestLayeredStoreWriteSkipsReadOnly(t *testing.T) {
+	env, writable, bottom := NewMemConfigStore(), NewMemConfigStore(), NewMemConfigStore()
+	s := NewLayeredConfigStore(readOnlyStore{env}, writable, bottom)
+
+	mustWrite(t, s, "key", "new")
+
+	for _, c := range []struct {
+		name  string
+		store ConfigStore
+		has   bool
+	}{
+		{"read-only layer", env, false},
+		{"first writable layer", writable, true},
+		{"lower layer", bottom, false},
+	} {
+		_, err := readName(c.store, "key")
+		if c.has && (err != nil) {
+			t.Errorf("value not written to the %v: %v", c.name, err)
+		}
+		if !c.has && (err != ErrNoConfig) {
+			t.Errorf("value written to the %v", c.name)
+		}
+	}
+}
+
+func TestLayeredStoreWriteAllReadOnly(t *testing.T) {
+	s := NewLayeredConfigStore(readOnlyStore{NewMemConfigStore()})
+
+	err := s.WriteValue("key", &testValue{})
+	if err != ErrReadOnly {
+		t.Errorf("WriteValue returned %v, want ErrReadOnly", err)
+	}
+}
+
+func TestLayeredStoreDelete(t *testing.T) {
+	env, top, bottom := NewMemConfigStore(), NewMemConfigStore(), NewMemConfigStore()
+	s := NewLayeredConfigStore(readOnlyStore{env}, top, bottom)
+
+	mustWrite(t, env, "key", "env")
+	mustWrite(t, top, "key", "top")
+	mustWrite(t, bottom, "key", "bottom")
+
+	err := s.DeleteValue("key")
+	if err != nil {
+		t.Fatalf("DeleteValue: %v", err)
+	}
+
+	// the delete mustn't uncover the value in the lower layer
+	for name, store := range map[string]ConfigStore{"top": top, "bottom": bottom} {
+		_, err := readName(store, "key")
+		if err != ErrNoConfig {
+			t.Errorf("value left in the %v layer", name)
+		}
+	}
+
+	// the read-only layer is left alone
+	got, err := readName(env, "key")
+	if (err != nil) || (got != "env") {
+		t.Errorf("read-only layer changed, read %q, %v", got, err)
+	}
+
+	err = s.DeleteValue("missing")
+	if err != ErrNoConfig {
+		t.Errorf("DeleteValue of a missing key returned %v, want ErrNoConfig", err)
+	}
+}
+
+func TestLayeredStoreKeys(t *testing.T) {
+	top, bottom := NewMemConfigStore(), NewMemConfigStore()
+	s := NewLayeredConfigStore(top, bottom)
+
+	mustWrite(t, top, "b", "top")
+	mustWrite(t, top, "c", "top")
+	mustWrite(t, bottom, "a", "bottom")
+	mustWrite(t, bottom, "b", "bottom")
+
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys returned %v, want %v", keys, want)
+	}
+}
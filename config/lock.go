@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Locker provides mutual exclusion that can fail, e.g. between processes
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// FileLock is an inter-process lock implemented with flock(2) on a file. The
+// lock is released by the kernel if the holding process exits, so a crashed
+// process can't leave it held.
+type FileLock struct {
+	path string
+
+	mu sync.Mutex // guards f
+	f  *os.File
+}
+
+var _ Locker = &FileLock{}
+
+// NewFileLock returns a FileLock on the file at path. The file and its
+// directory are created on the first call to Lock.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (l *FileLock) String() string {
+	return "FileLock(" + l.path + ")"
+}
+
+// Lock blocks until an exclusive lock on the file is held
+func (l *FileLock) Lock() error {
+	l.mu.Lock()
+
+	err := os.MkdirAll(filepath.Dir(l.path), DirPerms)
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, FilePerms)
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		l.mu.Unlock()
+		return err
+	}
+
+	l.f = f
+	return nil
+}
+
+// Unlock releases a lock acquired by Lock
+func (l *FileLock) Unlock() error {
+	defer l.mu.Unlock()
+
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	cerr := l.f.Close()
+	l.f = nil
+
+	if err != nil {
+		return err
+	}
+	return cerr
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Stores config values in memory, they are lost when the process exits.
+// Useful for dry runs and for testing against a store.
+type memConfigStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte // json encoded values by key
+}
+
+var _ ConfigStore = &memConfigStore{}
+
+func NewMemConfigStore() ConfigStore {
+	return &memConfigStore{values: make(map[string][]byte)}
+}
+
+func (c *memConfigStore) String() string {
+	return fmt.Sprintf("MemConfigStore(%v keys)", len(c.values))
+}
+
+func (c *memConfigStore) ReadValue(key string, v interface{}) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	b, ok := c.values[key]
+	if !ok {
+		return ErrNoConfig
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func (c *memConfigStore) WriteValue(key string, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.values[key] = b
+	return nil
+}
+
+func (c *memConfigStore) DeleteValue(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.values[key]; !ok {
+		return ErrNoConfig
+	}
+
+	delete(c.values, key)
+	return nil
+}
+
+func (c *memConfigStore) Keys() ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
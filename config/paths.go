@@ -0,0 +1,154 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNoHome = errors.New("Could not find the home directory, set $HOME or a config dir")
+
+// Dirs are the directories mzutil keeps its files in
+type Dirs struct {
+	Config string // settings, e.g. the auth config
+	Data   string // state and secrets, e.g. OAuth2 tokens
+	Cache  string // anything that can be fetched again, e.g. transactions
+}
+
+// XDGDirs returns the directories for app under the XDG base directories,
+// $XDG_CONFIG_HOME, $XDG_DATA_HOME and $XDG_CACHE_HOME, or their defaults
+// under $HOME if they aren't set
+func XDGDirs(app string) (Dirs, error) {
+	var dirs Dirs
+
+	for _, d := range []struct {
+		dir      *string
+		env      string
+		fallback string
+	}{
+		{&dirs.Config, "XDG_CONFIG_HOME", ".config"},
+		{&dirs.Data, "XDG_DATA_HOME", ".local/share"},
+		{&dirs.Cache, "XDG_CACHE_HOME", ".cache"},
+	} {
+		// the spec says relative paths should be ignored
+		base := os.Getenv(d.env)
+		if !filepath.IsAbs(base) {
+			var err error
+			base, err = HomePath(d.fallback)
+			if err != nil {
+				return dirs, err
+			}
+		}
+
+		*d.dir = filepath.Join(base, app)
+	}
+
+	return dirs, nil
+}
+
+// SingleDirs returns Dirs keeping config and data in dir, with the cache in
+// a subdirectory
+func SingleDirs(dir string) Dirs {
+	return Dirs{Config: dir, Data: dir, Cache: filepath.Join(dir, "cache")}
+}
+
+// HomePath returns path relative to the home directory, or path itself if it
+// is absolute
+func HomePath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		// $HOME isn't set, try the passwd entry
+		u, uerr := user.Current()
+		if (uerr != nil) || (u.HomeDir == "") {
+			return "", ErrNoHome
+		}
+		home = u.HomeDir
+	}
+
+	return filepath.Join(home, path), nil
+}
+
+// MigrateLegacyDir moves the values of a single directory file store, such as
+// ~/.mzutil, into dirs. Keys starting with dataPrefix go to dirs.Data and
+// the rest to dirs.Config. Existing files in dirs are never overwritten, any
+// such values are left in legacy. legacy is removed if it ends up empty.
+// Returns the number of values moved.
+func MigrateLegacyDir(legacy string, dirs Dirs, dataPrefix string) (int, error) {
+	fs, err := os.ReadDir(legacy)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, f := range fs {
+		name := f.Name()
+
+		switch {
+		case f.IsDir():
+			continue
+		case strings.HasSuffix(name, ".lock"):
+			// only held while running, so safe to drop
+			os.Remove(filepath.Join(legacy, name))
+			continue
+		case !strings.HasSuffix(name, ".json"):
+			continue
+		}
+
+		dir := dirs.Config
+		if (dataPrefix != "") && strings.HasPrefix(name, dataPrefix) {
+			dir = dirs.Data
+		}
+
+		dest := filepath.Join(dir, name)
+		if dir == legacy {
+			continue
+		}
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+
+		err = os.MkdirAll(dir, DirPerms)
+		if err != nil {
+			return moved, err
+		}
+
+		err = os.Rename(filepath.Join(legacy, name), dest)
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	// fails if anything was left behind, which is what we want
+	os.Remove(legacy)
+	return moved, nil
+}
+
+// MoveLegacyDir renames the directory legacy to dest, unless dest already
+// exists. Returns whether it was moved.
+func MoveLegacyDir(legacy, dest string) (bool, error) {
+	if _, err := os.Stat(legacy); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		return false, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(dest), DirPerms)
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(legacy, dest)
+	return err == nil, err
+}
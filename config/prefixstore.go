@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Namespaces the keys of another store with a prefix, so that several sets
+// of values can share one store
+type prefixConfigStore struct {
+	store  ConfigStore
+	prefix string
+}
+
+var _ ConfigStore = &prefixConfigStore{}
+var _ ReadOnlyStore = &prefixConfigStore{}
+
+// NewPrefixConfigStore returns a ConfigStore that adds prefix to the keys of
+// values in store
+func NewPrefixConfigStore(store ConfigStore, prefix string) ConfigStore {
+	return &prefixConfigStore{store: store, prefix: prefix}
+}
+
+func (c *prefixConfigStore) String() string {
+	return fmt.Sprintf("%v[%v*]", c.store, c.prefix)
+}
+
+func (c *prefixConfigStore) ReadOnly() bool {
+	return IsReadOnly(c.store)
+}
+
+func (c *prefixConfigStore) ReadValue(key string, v interface{}) error {
+	return c.store.ReadValue(c.prefix+key, v)
+}
+
+func (c *prefixConfigStore) WriteValue(key string, v interface{}) error {
+	return c.store.WriteValue(c.prefix+key, v)
+}
+
+func (c *prefixConfigStore) DeleteValue(key string) error {
+	return c.store.DeleteValue(c.prefix + key)
+}
+
+// Keys lists the keys in store with the prefix, without it
+func (c *prefixConfigStore) Keys() ([]string, error) {
+	all, err := c.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, k := range all {
+		if strings.HasPrefix(k, c.prefix) {
+			keys = append(keys, strings.TrimPrefix(k, c.prefix))
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// ActivationListener returns the socket passed by systemd socket activation,
+// or nil if the process wasn't socket activated. The LISTEN_* environment
+// variables are unset so that child processes don't use the socket.
+func ActivationListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if (err != nil) || (pid != os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if (err != nil) || (n < 1) {
+		return nil, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if n > 1 {
+		return nil, fmt.Errorf("expected 1 socket from systemd, got %v", n)
+	}
+
+	f := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/char8/mzutil/monzo"
+)
+
+// ErrRunning is returned by Listen if a daemon is already serving the socket
+var ErrRunning = errors.New("The daemon is already running")
+
+// dialTimeout is how long to wait for the daemon to accept a connection
+const dialTimeout = time.Second
+
+// callTimeout is how long to wait for the daemon to answer, it may have to
+// call the API for anything not cached
+const callTimeout = time.Minute
+
+// Client talks to a running daemon, it has the same methods as monzo.Client
+// for the requests the daemon answers
+type Client struct {
+	mu   sync.Mutex // guards the connection
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial connects to the daemon listening on the Unix socket at path
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// call sends req and decodes the result into v
+func (c *Client) call(req Request, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetDeadline(time.Now().Add(callTimeout))
+
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	var resp Response
+	err = json.Unmarshal(line, &resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	return json.Unmarshal(resp.Result, v)
+}
+
+func (c *Client) Status() (s Status, err error) {
+	err = c.call(Request{Method: MethodStatus}, &s)
+	return
+}
+
+func (c *Client) Accounts() (a []monzo.AccountResponse, err error) {
+	err = c.call(Request{Method: MethodAccounts}, &a)
+	return
+}
+
+func (c *Client) Balance(accountId string) (b monzo.BalanceResponse, err error) {
+	err = c.call(Request{Method: MethodBalance, AccountId: accountId}, &b)
+	return
+}
+
+func (c *Client) Pots(accountId string) (p []monzo.PotResponse, err error) {
+	err = c.call(Request{Method: MethodPots, AccountId: accountId}, &p)
+	return
+}
+
+func (c *Client) Transactions(accountId string, since time.Time) (t []monzo.TransactionResponse, err error) {
+	err = c.call(Request{Method: MethodTransactions, AccountId: accountId, Since: since}, &t)
+	return
+}
+
+var _ API = &Client{}
@@ -0,0 +1,46 @@
+// package daemon implements a long running process that holds the token,
+// polls the API and serves the results to other mzutil processes over a Unix
+// socket
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// The protocol is one JSON Request per line from the client, each answered
+// by one JSON Response line. A connection may carry any number of requests.
+
+// Request methods
+const (
+	MethodStatus       = "status"
+	MethodAccounts     = "accounts"
+	MethodBalance      = "balance"
+	MethodPots         = "pots"
+	MethodTransactions = "transactions"
+)
+
+// Request asks the daemon for something
+type Request struct {
+	Method    string    `json:"method"`
+	AccountId string    `json:"account_id,omitempty"`
+	Since     time.Time `json:"since,omitempty"` // for MethodTransactions
+}
+
+// Response answers a Request, Error is set if it failed
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Status is the result of MethodStatus
+type Status struct {
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"` // last successful poll
+	LastError string    `json:"last_error,omitempty"`
+	Accounts  int       `json:"accounts"`
+}
+
+// ErrUnknownMethod is returned for requests the daemon doesn't understand
+var ErrUnknownMethod = errors.New("Unknown daemon request method")
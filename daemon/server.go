@@ -0,0 +1,388 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/char8/mzutil/config"
+	"github.com/char8/mzutil/monzo"
+)
+
+// API is the part of monzo.Client that the daemon uses
+type API interface {
+	Accounts() ([]monzo.AccountResponse, error)
+	Balance(accountId string) (monzo.BalanceResponse, error)
+	Pots(accountId string) ([]monzo.PotResponse, error)
+	Transactions(accountId string, since time.Time) ([]monzo.TransactionResponse, error)
+}
+
+var _ API = &monzo.Client{}
+
+// Options control what the daemon polls
+type Options struct {
+	Interval time.Duration // time between polls
+	History  time.Duration // how far back to keep transactions
+}
+
+// recheck is how far back transactions are fetched again on each poll, as
+// pending transactions change when they settle
+const recheck = 7 * 24 * time.Hour
+
+// Server polls the API and answers requests from its cache
+type Server struct {
+	api  API
+	opts Options
+
+	mu       sync.RWMutex // guards everything below
+	status   Status
+	accounts []monzo.AccountResponse
+	balances map[string]monzo.BalanceResponse
+	pots     map[string][]monzo.PotResponse
+	txs      map[string][]monzo.TransactionResponse
+	synced   map[string]bool // accounts with History of transactions
+}
+
+// Snapshot is a copy of what the Server has cached, by account id
+type Snapshot struct {
+	Status       Status                                 `json:"status"`
+	Accounts     []monzo.AccountResponse                `json:"accounts"`
+	Balances     map[string]monzo.BalanceResponse       `json:"balances"`
+	Pots         map[string][]monzo.PotResponse         `json:"pots"`
+	Transactions map[string][]monzo.TransactionResponse `json:"transactions"`
+}
+
+// NewServer returns a Server polling api, call Run to start polling and
+// Serve to answer requests
+func NewServer(api API, opts Options) *Server {
+	return &Server{
+		api:      api,
+		opts:     opts,
+		status:   Status{Started: time.Now()},
+		balances: make(map[string]monzo.BalanceResponse),
+		pots:     make(map[string][]monzo.PotResponse),
+		txs:      make(map[string][]monzo.TransactionResponse),
+		synced:   make(map[string]bool),
+	}
+}
+
+// Run polls the API every opts.Interval until ctx is done
+func (s *Server) Run(ctx context.Context) {
+	t := time.NewTicker(s.opts.Interval)
+	defer t.Stop()
+
+	for {
+		err := s.Poll()
+		if err != nil {
+			log.WithError(err).Error("poll failed")
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Poll fetches accounts, balances, pots and recent transactions into the
+// cache
+func (s *Server) Poll() error {
+	err := s.poll()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.status.LastError = err.Error()
+		return err
+	}
+
+	s.status.LastError = ""
+	s.status.Updated = time.Now()
+	return nil
+}
+
+func (s *Server) poll() error {
+	accounts, err := s.api.Accounts()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.accounts = accounts
+	s.status.Accounts = len(accounts)
+	s.mu.Unlock()
+
+	for _, a := range accounts {
+		_, err := s.fetchBalance(a.Id)
+		if err != nil {
+			return err
+		}
+
+		// not every type of account has pots
+		_, err = s.fetchPots(a.Id)
+		if err != nil {
+			log.WithError(err).WithField("account", a.Id).Warn("could not fetch pots")
+		}
+
+		err = s.fetchTransactions(a.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchBalance gets the balance of an account and caches it
+func (s *Server) fetchBalance(accountId string) (monzo.BalanceResponse, error) {
+	b, err := s.api.Balance(accountId)
+	if err != nil {
+		return b, err
+	}
+
+	s.mu.Lock()
+	s.balances[accountId] = b
+	s.mu.Unlock()
+	return b, nil
+}
+
+// fetchPots gets the pots of an account, leaving out deleted pots, and
+// caches them
+func (s *Server) fetchPots(accountId string) ([]monzo.PotResponse, error) {
+	all, err := s.api.Pots(accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	pots := make([]monzo.PotResponse, 0, len(all))
+	for _, p := range all {
+		if !p.Deleted {
+			pots = append(pots, p)
+		}
+	}
+
+	s.mu.Lock()
+	s.pots[accountId] = pots
+	s.mu.Unlock()
+	return pots, nil
+}
+
+// fetchTransactions gets the transactions of an account since the last poll,
+// or for all of History on the first poll, merging them into the cache
+func (s *Server) fetchTransactions(accountId string) error {
+	now := time.Now()
+	oldest := now.Add(-s.opts.History)
+
+	s.mu.RLock()
+	since := oldest
+	if s.synced[accountId] && (s.opts.History > recheck) {
+		since = now.Add(-recheck)
+	}
+	s.mu.RUnlock()
+
+	txs, err := s.api.Transactions(accountId, since)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byId := make(map[string]monzo.TransactionResponse)
+	for _, t := range s.txs[accountId] {
+		if t.Created.After(oldest) {
+			byId[t.Id] = t
+		}
+	}
+	for _, t := range txs {
+		byId[t.Id] = t
+	}
+
+	merged := make([]monzo.TransactionResponse, 0, len(byId))
+	for _, t := range byId {
+		merged = append(merged, t)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Created.Before(merged[j].Created) })
+
+	s.txs[accountId] = merged
+	s.synced[accountId] = true
+	return nil
+}
+
+// Snapshot returns a copy of the cache
+func (s *Server) Snapshot() Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := Snapshot{
+		Status:       s.status,
+		Accounts:     append([]monzo.AccountResponse(nil), s.accounts...),
+		Balances:     make(map[string]monzo.BalanceResponse, len(s.balances)),
+		Pots:         make(map[string][]monzo.PotResponse, len(s.pots)),
+		Transactions: make(map[string][]monzo.TransactionResponse, len(s.txs)),
+	}
+
+	for k, v := range s.balances {
+		snap.Balances[k] = v
+	}
+	for k, v := range s.pots {
+		snap.Pots[k] = append([]monzo.PotResponse(nil), v...)
+	}
+	for k, v := range s.txs {
+		snap.Transactions[k] = append([]monzo.TransactionResponse(nil), v...)
+	}
+
+	return snap
+}
+
+// Serve answers requests on l until ctx is done
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// handle answers requests on conn until it is closed
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+
+	for sc.Scan() {
+		var req Request
+		var resp Response
+
+		err := json.Unmarshal(sc.Bytes(), &req)
+		var v interface{}
+		if err == nil {
+			v, err = s.do(req)
+		}
+		if err == nil {
+			resp.Result, err = json.Marshal(v)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+
+		err = enc.Encode(&resp)
+		if err != nil {
+			log.WithError(err).Debug("could not write daemon response")
+			return
+		}
+	}
+}
+
+// do answers req from the cache, fetching anything that isn't cached
+func (s *Server) do(req Request) (interface{}, error) {
+	switch req.Method {
+	case MethodStatus:
+		s.mu.RLock()
+		status := s.status
+		s.mu.RUnlock()
+		return status, nil
+	case MethodAccounts:
+		s.mu.RLock()
+		accounts := s.accounts
+		s.mu.RUnlock()
+		if accounts != nil {
+			return accounts, nil
+		}
+		return s.api.Accounts()
+	case MethodBalance:
+		s.mu.RLock()
+		b, ok := s.balances[req.AccountId]
+		s.mu.RUnlock()
+		if ok {
+			return b, nil
+		}
+		return s.fetchBalance(req.AccountId)
+	case MethodPots:
+		s.mu.RLock()
+		p, ok := s.pots[req.AccountId]
+		s.mu.RUnlock()
+		if ok {
+			return p, nil
+		}
+		return s.fetchPots(req.AccountId)
+	case MethodTransactions:
+		txs, ok := s.cachedTransactions(req.AccountId, req.Since)
+		if ok {
+			return txs, nil
+		}
+		return s.api.Transactions(req.AccountId, req.Since)
+	default:
+		return nil, ErrUnknownMethod
+	}
+}
+
+// cachedTransactions returns the cached transactions of an account created
+// since since, if the cache goes back that far
+func (s *Server) cachedTransactions(accountId string, since time.Time) ([]monzo.TransactionResponse, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	oldest := time.Now().Add(-s.opts.History)
+	if !s.synced[accountId] || since.Before(oldest) {
+		return nil, false
+	}
+
+	var txs []monzo.TransactionResponse
+	for _, t := range s.txs[accountId] {
+		if !t.Created.Before(since) {
+			txs = append(txs, t)
+		}
+	}
+	return txs, true
+}
+
+// Listen listens on a Unix socket at path that only the user can connect to.
+// A socket left behind by a daemon that is no longer running is replaced.
+func Listen(path string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(path), config.DirPerms)
+	if err != nil {
+		return nil, err
+	}
+
+	if c, err := Dial(path); err == nil {
+		c.Close()
+		return nil, ErrRunning
+	}
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, config.FilePerms)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/char8/mzutil/monzo"
+)
+
+var errFakeAPI = errors.New("500 Internal Server Error")
+
+// fakeAPI answers like the API, or fails every call once fail is set
+type fakeAPI struct {
+	mu      sync.Mutex
+	fail    bool
+	balance int64
+}
+
+func (f *fakeAPI) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail {
+		return errFakeAPI
+	}
+	return nil
+}
+
+func (f *fakeAPI) setFail(fail bool) {
+	f.mu.Lock()
+	f.fail = fail
+	f.mu.Unlock()
+}
+
+func (f *fakeAPI) Accounts() ([]monzo.AccountResponse, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	return []monzo.AccountResponse{{Id: "acc"}}, nil
+}
+
+func (f *fakeAPI) Balance(accountId string) (monzo.BalanceResponse, error) {
+	if err := f.err(); err != nil {
+		return monzo.BalanceResponse{}, err
+	}
+	return monzo.BalanceResponse{Balance: f.balance, TotalBalance: f.balance, Currency: "GBP"}, nil
+}
+
+func (f *fakeAPI) Pots(accountId string) ([]monzo.PotResponse, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	return []monzo.PotResponse{{Id: "pot", Name: "Savings", Balance: 100}, {Id: "old", Deleted: true}}, nil
+}
+
+func (f *fakeAPI) Transactions(accountId string, since time.Time) ([]monzo.TransactionResponse, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	return []monzo.TransactionResponse{{Id: "tx", Created: time.Now().Add(-time.Hour), Amount: -250}}, nil
+}
+
+func TestPollCaches(t *testing.T) {
+	s := NewServer(&fakeAPI{balance: 1234}, Options{Interval: time.Minute, History: 24 * time.Hour})
+
+	err := s.Poll()
+	if err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+
+	snap := s.Snapshot()
+	if (len(snap.Accounts) != 1) || (snap.Balances["acc"].Balance != 1234) {
+		t.Errorf("snapshot has accounts %v, balances %v", snap.Accounts, snap.Balances)
+	}
+	if (len(snap.Pots["acc"]) != 1) || (snap.Pots["acc"][0].Id != "pot") {
+		t.Errorf("snapshot has pots %v, want only the pot that isn't deleted", snap.Pots["acc"])
+	}
+	if len(snap.Transactions["acc"]) != 1 {
+		t.Errorf("snapshot has transactions %v", snap.Transactions["acc"])
+	}
+	if snap.Status.Updated.IsZero() || (snap.Status.LastError != "") {
+		t.Errorf("status after a good poll is %+v", snap.Status)
+	}
+}
+
+func TestFailedPollKeepsSnapshot(t *testing.T) {
+	api := &fakeAPI{balance: 1234}
+	s := NewServer(api, Options{Interval: time.Minute, History: 24 * time.Hour})
+
+	err := s.Poll()
+	if err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+	good := s.Snapshot()
+
+	api.setFail(true)
+	err = s.Poll()
+	if err != errFakeAPI {
+		t.Fatalf("Poll returned %v, want %v", err, errFakeAPI)
+	}
+
+	snap := s.Snapshot()
+
+	// the last good values are kept, only the status shows the failure
+	if snap.Status.LastError != errFakeAPI.Error() {
+		t.Errorf("status LastError is %q", snap.Status.LastError)
+	}
+	if !snap.Status.Updated.Equal(good.Status.Updated) {
+		t.Errorf("failed poll changed Updated from %v to %v", good.Status.Updated, snap.Status.Updated)
+	}
+
+	snap.Status, good.Status = Status{}, Status{}
+	if !reflect.DeepEqual(snap, good) {
+		t.Errorf("failed poll changed the snapshot from %+v to %+v", good, snap)
+	}
+}
+
+func TestDoDoesNotCacheFailures(t *testing.T) {
+	api := &fakeAPI{fail: true}
+	s := NewServer(api, Options{Interval: time.Minute, History: 24 * time.Hour})
+
+	_, err := s.do(Request{Method: MethodBalance, AccountId: "acc"})
+	if err != errFakeAPI {
+		t.Fatalf("balance request returned %v, want %v", err, errFakeAPI)
+	}
+
+	// a failed fetch mustn't leave a zero balance behind
+	api.setFail(false)
+	api.mu.Lock()
+	api.balance = 500
+	api.mu.Unlock()
+
+	v, err := s.do(Request{Method: MethodBalance, AccountId: "acc"})
+	if err != nil {
+		t.Fatalf("balance request: %v", err)
+	}
+	if b := v.(monzo.BalanceResponse); b.Balance != 500 {
+		t.Errorf("balance request returned %+v", b)
+	}
+}
@@ -3,7 +3,11 @@ package monzo
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/char8/mzutil/auth"
@@ -11,41 +15,90 @@ import (
 )
 
 type BalanceResponse struct {
-	Balance    int64  `json:'balance'`
-	Currency   string `json:'currency'`
-	SpendToday int64  `json:'spend_today'`
+	Balance      int64  `json:"balance"`
+	TotalBalance int64  `json:"total_balance"` // including pots
+	Currency     string `json:"currency"`
+	SpendToday   int64  `json:"spend_today"`
+}
+
+type PotResponse struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Balance  int64  `json:"balance"`
+	Currency string `json:"currency"`
+	Deleted  bool   `json:"deleted"`
+}
+
+type PotsResponse struct {
+	Pots []PotResponse `json:"pots"`
+}
+
+type TransactionResponse struct {
+	Id                string    `json:"id"`
+	Created           time.Time `json:"created"`
+	Desc              string    `json:"description"`
+	Amount            int64     `json:"amount"`
+	Currency          string    `json:"currency"`
+	Category          string    `json:"category"`
+	IncludeInSpending bool      `json:"include_in_spending"`
+	DeclineReason     string    `json:"decline_reason,omitempty"`
+}
+
+type TransactionsResponse struct {
+	Transactions []TransactionResponse `json:"transactions"`
 }
 
 type AccountResponse struct {
-	Id      string    `json:'id'`
-	Desc    string    `json:'description'`
-	Created time.Time `json:'created'`
+	Id      string    `json:"id"`
+	Desc    string    `json:"description"`
+	Created time.Time `json:"created"`
 }
 
 type AccountsResponse struct {
-	Accounts []AccountResponse `json:'accounts'`
+	Accounts []AccountResponse `json:"accounts"`
 }
 
 type WhoAmIResponse struct {
-	Authenticated bool   `json:'authenticated'`
-	ClientId      string `json:'client_id'`
-	UserId        string `json:'user_id'`
+	Authenticated bool   `json:"authenticated"`
+	ClientId      string `json:"client_id"`
+	UserId        string `json:"user_id"`
 }
 
 type Client struct {
 	httpClient *http.Client
 }
 
-func NewClient(ctx context.Context, a auth.Authenticator) *Client {
-	return &Client{
-		httpClient: a.NewHttpClient(ctx),
+// NewClient returns a Client using tokens from a, or ErrNotLoggedIn if
+// there is no token
+func NewClient(ctx context.Context, a auth.Authenticator) (*Client, error) {
+	hc, err := a.NewHttpClient(ctx)
+	if err != nil {
+		return nil, err
 	}
+
+	return &Client{httpClient: hc}, nil
 }
 
 func (c *Client) HttpClient() *http.Client {
 	return c.httpClient
 }
 
+// APIError is returned when the API answers with an unexpected status
+type APIError struct {
+	StatusCode int
+	Status     string
+	Message    string // from the error body, if the API gave one
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return "Monzo API error: " + e.Status
+	}
+	return fmt.Sprintf("Monzo API error: %v: %v", e.Status, e.Message)
+}
+
+// handleError returns the error for a failed request, closing the body of
+// resp if there is one
 func handleError(resp *http.Response, err error) error {
 	le := log.WithError(err)
 	if resp != nil {
@@ -53,14 +106,31 @@ func handleError(resp *http.Response, err error) error {
 	}
 	le.Error("request error")
 
+	// no response at all, e.g. a network error
+	if resp == nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
 	switch resp.StatusCode {
 	case http.StatusUnauthorized:
 		return ErrAuthError
 	case http.StatusForbidden:
 		return ErrAuthError
-	default:
-		return err
 	}
+
+	apiErr := &APIError{StatusCode: resp.StatusCode, Status: resp.Status}
+
+	// error bodies look like {"code": "...", "message": "..."}
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body) == nil {
+		apiErr.Message = body.Message
+	}
+
+	return apiErr
 }
 
 func (c *Client) Balance(accountId string) (b BalanceResponse, err error) {
@@ -71,7 +141,8 @@ func (c *Client) Balance(accountId string) (b BalanceResponse, err error) {
 		return b, handleError(resp, err)
 	}
 
-	log.Error(resp.StatusCode)
+	defer resp.Body.Close()
+
 	jd := json.NewDecoder(resp.Body)
 	err = jd.Decode(&b)
 
@@ -86,6 +157,8 @@ func (c *Client) WhoAmI() (w WhoAmIResponse, err error) {
 		return w, handleError(resp, err)
 	}
 
+	defer resp.Body.Close()
+
 	jd := json.NewDecoder(resp.Body)
 	err = jd.Decode(&w)
 
@@ -100,6 +173,8 @@ func (c *Client) Accounts() (a []AccountResponse, err error) {
 		return a, handleError(resp, err)
 	}
 
+	defer resp.Body.Close()
+
 	accs := AccountsResponse{}
 
 	jd := json.NewDecoder(resp.Body)
@@ -111,3 +186,86 @@ func (c *Client) Accounts() (a []AccountResponse, err error) {
 
 	return accs.Accounts, nil
 }
+
+// transactionsPageSize is the most transactions the API returns per request
+const transactionsPageSize = 100
+
+// Transactions returns the transactions on an account created since since,
+// oldest first. The API returns them in pages, which are fetched until a
+// short page comes back.
+func (c *Client) Transactions(accountId string, since time.Time) (t []TransactionResponse, err error) {
+	after := ""
+	if !since.IsZero() {
+		after = since.UTC().Format(time.RFC3339)
+	}
+
+	for {
+		page, err := c.transactionsPage(accountId, after)
+		if err != nil {
+			return t, err
+		}
+
+		t = append(t, page...)
+		if len(page) < transactionsPageSize {
+			return t, nil
+		}
+
+		// the next page starts after the last transaction of this one
+		after = page[len(page)-1].Id
+	}
+}
+
+// transactionsPage returns a page of the transactions on an account created
+// after since, a time or a transaction id, or from the start if it is empty
+func (c *Client) transactionsPage(accountId string, since string) (t []TransactionResponse, err error) {
+	q := url.Values{}
+	q.Set("account_id", accountId)
+	q.Set("limit", strconv.Itoa(transactionsPageSize))
+	if since != "" {
+		q.Set("since", since)
+	}
+
+	resp, err := c.httpClient.Get("https://api.monzo.com/transactions?" + q.Encode())
+
+	if (err != nil) || (resp.StatusCode != http.StatusOK) {
+		return t, handleError(resp, err)
+	}
+
+	defer resp.Body.Close()
+
+	txs := TransactionsResponse{}
+
+	jd := json.NewDecoder(resp.Body)
+	err = jd.Decode(&txs)
+
+	if err != nil {
+		return
+	}
+
+	return txs.Transactions, nil
+}
+
+// Pots returns the pots of an account, including deleted pots
+func (c *Client) Pots(accountId string) (p []PotResponse, err error) {
+	q := url.Values{}
+	q.Set("current_account_id", accountId)
+
+	resp, err := c.httpClient.Get("https://api.monzo.com/pots?" + q.Encode())
+
+	if (err != nil) || (resp.StatusCode != http.StatusOK) {
+		return p, handleError(resp, err)
+	}
+
+	defer resp.Body.Close()
+
+	pots := PotsResponse{}
+
+	jd := json.NewDecoder(resp.Body)
+	err = jd.Decode(&pots)
+
+	if err != nil {
+		return
+	}
+
+	return pots.Pots, nil
+}
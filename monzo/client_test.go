@@ -0,0 +1,133 @@
+package monzo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// roundTripFunc answers requests to the API in tests
+type roundTripFunc func(*http.Request) *http.Response
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+func testClient(f func(w http.ResponseWriter, req *http.Request)) *Client {
+	return &Client{httpClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		f(w, req)
+		return w.Result()
+	})}}
+}
+
+func TestClientErrorStatus(t *testing.T) {
+	c := testClient(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"code":"internal_service","message":"try again"}`)
+	})
+
+	_, err := c.Balance("acc")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Balance returned %v, want an *APIError", err)
+	}
+	if (apiErr.StatusCode != http.StatusInternalServerError) || (apiErr.Message != "try again") {
+		t.Errorf("Balance returned %+v", apiErr)
+	}
+
+	// every call must fail rather than return an empty result
+	calls := map[string]func() error{
+		"Accounts": func() error { _, err := c.Accounts(); return err },
+		"WhoAmI":   func() error { _, err := c.WhoAmI(); return err },
+		"Pots":     func() error { _, err := c.Pots("acc"); return err },
+		"Transactions": func() error {
+			_, err := c.Transactions("acc", time.Time{})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.As(err, &apiErr) {
+			t.Errorf("%v returned %v, want an *APIError", name, err)
+		}
+	}
+}
+
+func TestClientErrorWithoutBody(t *testing.T) {
+	c := testClient(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	_, err := c.Accounts()
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || (apiErr.StatusCode != http.StatusBadGateway) {
+		t.Errorf("Accounts returned %v, want an *APIError with status 502", err)
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	c := testClient(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	_, err := c.Accounts()
+	if err != ErrAuthError {
+		t.Errorf("Accounts returned %v, want ErrAuthError", err)
+	}
+}
+
+func TestTransactionsPages(t *testing.T) {
+	const total = 2*transactionsPageSize + 50
+
+	var queries []url.Values
+	c := testClient(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		queries = append(queries, q)
+
+		// transaction ids are tx<n>, since is a time or the last id seen
+		start := 0
+		if since := q.Get("since"); (len(since) > 2) && (since[:2] == "tx") {
+			n, _ := strconv.Atoi(since[2:])
+			start = n + 1
+		}
+
+		var resp TransactionsResponse
+		for i := start; (i < total) && (i < start+transactionsPageSize); i++ {
+			resp.Transactions = append(resp.Transactions, TransactionResponse{Id: fmt.Sprintf("tx%d", i)})
+		}
+		json.NewEncoder(w).Encode(&resp)
+	})
+
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	txs, err := c.Transactions("acc", since)
+	if err != nil {
+		t.Fatalf("Transactions: %v", err)
+	}
+
+	if len(txs) != total {
+		t.Fatalf("got %v transactions, want %v", len(txs), total)
+	}
+	for i, tx := range txs {
+		if tx.Id != fmt.Sprintf("tx%d", i) {
+			t.Fatalf("transaction %v has id %v", i, tx.Id)
+		}
+	}
+
+	want := []string{"2020-01-02T03:04:05Z", "tx99", "tx199"}
+	if len(queries) != len(want) {
+		t.Fatalf("made %v requests, want %v", len(queries), len(want))
+	}
+	for i, q := range queries {
+		if (q.Get("since") != want[i]) || (q.Get("limit") != strconv.Itoa(transactionsPageSize)) || (q.Get("account_id") != "acc") {
+			t.Errorf("request %v had query %v", i, q.Encode())
+		}
+	}
+}
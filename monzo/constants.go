@@ -1,7 +1,28 @@
 package monzo
 
+import "github.com/char8/mzutil/auth"
+
 const (
 	AuthConfigKey       = "auth-config"
-	FileStoreDir        = ".mzutil"
+	CallbackCertKey     = auth.CallbackCertKey
+	CallbackCertFile    = "callback-cert.pem"
+	CallbackPageFile    = "callback.html"
+	AppName             = "mzutil"
+	ConfigDirEnv        = "MZUTIL_CONFIG_DIR"
+	DaemonSocketFile    = "daemon.sock"
+	DaemonSocketEnv     = "MZUTIL_SOCKET"
+	EncryptedStoreDir   = "encrypted"
+	LegacyFileStoreDir  = ".mzutil"
+	LegacyEncryptedDir  = ".mzutil-encrypted"
+	PassphraseEnv       = "MZUTIL_PASSPHRASE"
+	ProfileEnv          = "MZUTIL_PROFILE"
+	DefaultProfile      = "default"
+	ProfilesDir         = "profiles"
+	PassStorePrefix     = "mzutil"
+	ServiceDir          = "service"
+	ServiceEnvFile      = "service.env"
+	SyncSnapshotKey     = "snapshot"
+	EnvPrefix           = "MZUTIL_"
 	KeychainServiceName = "mzutil"
+	TokenName           = "monzo"
 )